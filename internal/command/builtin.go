@@ -0,0 +1,154 @@
+package command
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// builtinMountConfig overrides one of the mounts every sandbox gets
+type builtinMountConfig struct {
+	Options  []string `json:"options"`
+	Size     string   `json:"size"`
+	Disabled bool     `json:"disabled"`
+}
+
+// builtinMounts are mounted over the root in this order
+var builtinMounts = []specs.Mount{
+	{
+		Destination: "/dev",
+		Type:        "tmpfs",
+		Source:      "tmpfs",
+		Options:     []string{"nosuid", "strictatime", "mode=755", "size=65536k"},
+	},
+	{
+		Destination: "/dev/pts",
+		Type:        "devpts",
+		Source:      "devpts",
+		Options:     []string{"nosuid", "noexec", "newinstance", "ptmxmode=0666", "mode=0620", "gid=5"},
+	},
+	{
+		Destination: "/dev/shm",
+		Type:        "tmpfs",
+		Source:      "shm",
+		Options:     []string{"nosuid", "noexec", "nodev", "mode=1777", "size=65536k"},
+	},
+	{
+		Destination: "/dev/mqueue",
+		Type:        "mqueue",
+		Source:      "mqueue",
+		Options:     []string{"nosuid", "noexec", "nodev"},
+	},
+}
+
+// requiredBuiltinMounts cannot be disabled, the sandbox does not work without them
+var requiredBuiltinMounts = []string{"/dev", "/dev/pts"}
+
+// validateBuiltinMounts checks the overrides of the built-in mounts
+func validateBuiltinMounts(c *specConfig) error {
+	if c.ShmSize != "" {
+		if c.BuiltinMounts == nil {
+			c.BuiltinMounts = map[string]builtinMountConfig{}
+		}
+		shm := c.BuiltinMounts["/dev/shm"]
+		shm.Size = c.ShmSize
+		c.BuiltinMounts["/dev/shm"] = shm
+	}
+	for dst, o := range c.BuiltinMounts {
+		m, ok := builtinMount(dst)
+		if !ok {
+			return fmt.Errorf("%s is not a built-in mount, expected one of %s", dst, strings.Join(builtinDestinations(), ", "))
+		}
+		if o.Disabled {
+			for _, required := range requiredBuiltinMounts {
+				if dst == required {
+					return fmt.Errorf("built-in mount %s is required and cannot be disabled", dst)
+				}
+			}
+			continue
+		}
+		if o.Size != "" {
+			if m.Type != "tmpfs" {
+				return fmt.Errorf("built-in mount %s is not a tmpfs and has no size", dst)
+			}
+			if !tmpfsSizePattern.MatchString(o.Size) {
+				return fmt.Errorf("built-in mount %s: invalid size %q", dst, o.Size)
+			}
+		}
+		for _, opt := range o.Options {
+			if !isBuiltinMountOption(m.Type, opt) {
+				return fmt.Errorf("built-in mount %s: unsupported option %q", dst, opt)
+			}
+		}
+	}
+	return nil
+}
+
+// builtinMount returns the default built-in mount on dst
+func builtinMount(dst string) (specs.Mount, bool) {
+	for _, m := range builtinMounts {
+		if m.Destination == dst {
+			return m, true
+		}
+	}
+	return specs.Mount{}, false
+}
+
+func builtinDestinations() []string {
+	var dsts []string
+	for _, m := range builtinMounts {
+		dsts = append(dsts, m.Destination)
+	}
+	sort.Strings(dsts)
+	return dsts
+}
+
+func isBuiltinMountOption(fsType, opt string) bool {
+	if _, ok := mountOptions[opt]; ok {
+		return true
+	}
+	switch fsType {
+	case "tmpfs":
+		return isTmpfsOption(opt)
+	case "devpts":
+		if opt == "newinstance" {
+			return true
+		}
+		for _, prefix := range []string{"ptmxmode=", "mode=", "gid=", "uid="} {
+			if strings.HasPrefix(opt, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sandboxBuiltinMounts returns the built-in mounts with the overrides applied.
+// Options replace the defaults, a size replaces the size= option.
+func sandboxBuiltinMounts(c specConfig) []specs.Mount {
+	var mounts []specs.Mount
+	for _, m := range builtinMounts {
+		o := c.BuiltinMounts[m.Destination]
+		if o.Disabled {
+			continue
+		}
+		options := m.Options
+		if o.Options != nil {
+			options = o.Options
+		}
+		if o.Size != "" {
+			sized := []string{}
+			for _, opt := range options {
+				if !strings.HasPrefix(opt, "size=") {
+					sized = append(sized, opt)
+				}
+			}
+			options = append(sized, "size="+o.Size)
+		}
+		m.Options = append([]string{}, options...)
+		mounts = append(mounts, m)
+	}
+	return mounts
+}
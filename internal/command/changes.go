@@ -0,0 +1,269 @@
+package command
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+)
+
+type changeKind int
+
+const (
+	changeModify changeKind = iota
+	changeAdd
+	changeDelete
+	// changeReserved is a file named like a whiteout, which can not be exported
+	changeReserved
+)
+
+// change is a path added, modified or deleted in the writable layer
+type change struct {
+	Path string
+	Kind changeKind
+}
+
+func (c change) String() string {
+	return fmt.Sprintf("%s %s", [...]string{"C", "A", "D", "!"}[c.Kind], c.Path)
+}
+
+// isWhiteout reports whether fi is an overlayfs whiteout, a 0/0 character device
+func isWhiteout(fi os.FileInfo) bool {
+	if fi.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && st.Rdev == 0
+}
+
+// isReservedName reports whether a file in the writable layer is named like a
+// whiteout. Exported, it would delete files wherever the changes are applied.
+func isReservedName(fi os.FileInfo) bool {
+	return !isWhiteout(fi) && strings.HasPrefix(fi.Name(), whiteoutPrefix)
+}
+
+// isOpaque reports whether the overlayfs directory hides the lower content
+func isOpaque(path string) bool {
+	buf := make([]byte, 1)
+	n, err := unix.Lgetxattr(path, "trusted.overlay.opaque", buf)
+	return err == nil && n == 1 && buf[0] == 'y'
+}
+
+// walkUpper walks the writable layer in lexical order, calling fn with the
+// path inside the sandbox for every entry
+func walkUpper(upper string, fn func(path string, fi os.FileInfo) error) error {
+	return filepath.Walk(upper, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(upper, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		return fn("/"+rel, fi)
+	})
+}
+
+// sandboxChanges lists the changes recorded in the writable layer of a sandbox
+func sandboxChanges(s *sandboxState) ([]change, error) {
+	var changes []change
+	upper := upperDir(s.stateDir)
+	err := walkUpper(upper, func(path string, fi os.FileInfo) error {
+		if isWhiteout(fi) {
+			changes = append(changes, change{Path: path, Kind: changeDelete})
+			return nil
+		}
+		if isReservedName(fi) {
+			changes = append(changes, change{Path: path, Kind: changeReserved})
+			return nil
+		}
+		if _, err := s.lowerStat(path); err != nil {
+			changes = append(changes, change{Path: path, Kind: changeAdd})
+			return nil
+		}
+		changes = append(changes, change{Path: path, Kind: changeModify})
+		if fi.IsDir() && isOpaque(filepath.Join(upper, path)) {
+			// the lower content of an opaque directory is gone unless it was recreated
+			names, err := s.lowerNames(path)
+			if err != nil {
+				return err
+			}
+			for _, name := range names {
+				if _, err := os.Lstat(filepath.Join(upper, path, name)); os.IsNotExist(err) {
+					changes = append(changes, change{Path: filepath.Join(path, name), Kind: changeDelete})
+				}
+			}
+		}
+		return nil
+	})
+	return changes, err
+}
+
+// exportChanges writes the writable layer of a sandbox as an OCI layer tarball
+func exportChanges(s *sandboxState, w io.Writer) error {
+	upper := upperDir(s.stateDir)
+	tw := tar.NewWriter(w)
+	links := map[uint64]string{}
+	err := walkUpper(upper, func(path string, fi os.FileInfo) error {
+		name := strings.TrimPrefix(path, "/")
+		if isReservedName(fi) {
+			return fmt.Errorf("%s: names starting with %s are reserved for whiteouts and can not be exported", path, whiteoutPrefix)
+		}
+		if isWhiteout(fi) {
+			return tw.WriteHeader(&tar.Header{
+				Name:     filepath.Join(filepath.Dir(name), whiteoutPrefix+fi.Name()),
+				Typeflag: tar.TypeReg,
+				Mode:     0600,
+				ModTime:  fi.ModTime(),
+			})
+		}
+
+		var link string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(filepath.Join(upper, path))
+			if err != nil {
+				return err
+			}
+			link = target
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok && fi.Mode().IsRegular() && st.Nlink > 1 {
+			if first, ok := links[st.Ino]; ok {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first
+				hdr.Size = 0
+			} else {
+				links[st.Ino] = name
+			}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			f, err := os.Open(filepath.Join(upper, path))
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(tw, f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+		if fi.IsDir() && isOpaque(filepath.Join(upper, path)) {
+			return tw.WriteHeader(&tar.Header{
+				Name:     filepath.Join(name, whiteoutOpaque),
+				Typeflag: tar.TypeReg,
+				Mode:     0600,
+				ModTime:  fi.ModTime(),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func newDiffCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "diff SANDBOX",
+		Short: "List the files added, modified and deleted in a sandbox",
+		Args:  ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			s, err := loadOverlaySandbox(args[0])
+			if err != nil {
+				return err
+			}
+			changes, err := sandboxChanges(s)
+			if err != nil {
+				return err
+			}
+			for _, c := range changes {
+				fmt.Fprintln(cmd.OutOrStdout(), c)
+			}
+			return nil
+		},
+	}
+}
+
+func newExportChangesCommand() *cobra.Command {
+	var output string
+	cmd := &cobra.Command{
+		Use:   "export-changes SANDBOX",
+		Short: "Export the changes of a sandbox as an OCI layer tarball",
+		Args:  ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			s, err := loadOverlaySandbox(args[0])
+			if err != nil {
+				return err
+			}
+			if output == "" || output == "-" {
+				return exportChanges(s, cmd.OutOrStdout())
+			}
+			f, err := os.Create(output)
+			if err != nil {
+				return err
+			}
+			if err := exportChanges(s, f); err != nil {
+				f.Close()
+				return err
+			}
+			return f.Close()
+		},
+	}
+	cmd.Flags().StringVarP(&output, "output", "o", "", "Write to a file instead of stdout")
+	return cmd
+}
+
+func newApplyChangesCommand() *cobra.Command {
+	var root string
+	cmd := &cobra.Command{
+		Use:   "apply-changes FILE [PATH...]",
+		Short: "Apply exported changes to the host, optionally only below the given paths",
+		Args:  RequiresMinArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			f, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return extractLayer(f, root, whiteoutRemove, pathFilter(args[1:]))
+		},
+	}
+	cmd.Flags().StringVar(&root, "root", "/", "Directory to apply the changes to")
+	return cmd
+}
+
+// pathFilter accepts the paths equal to or below one of the given paths
+func pathFilter(paths []string) func(string) bool {
+	if len(paths) == 0 {
+		return nil
+	}
+	return func(path string) bool {
+		for _, p := range paths {
+			p = filepath.Clean("/" + p)
+			if p == "/" || path == p || strings.HasPrefix(path, p+"/") {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,65 @@
+package command
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// commitSandbox snapshots the writable layer of a sandbox as a new layer on
+// top of the image it was started from
+func commitSandbox(s *sandboxState, name, comment string) (*image, error) {
+	if s.image == nil {
+		return nil, fmt.Errorf("sandbox %s was not started from an image, start it with --image to commit it", s.id)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(exportChanges(s, pw))
+	}()
+	diffID, err := unpackLayer(pr, "")
+	pr.CloseWithError(err)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	img := &image{
+		Name:   name,
+		Layers: append(append([]string{}, s.image.Layers...), diffID),
+		Config: s.image.Config,
+		History: append(append([]imageHistory{}, s.image.History...), imageHistory{
+			Created:   &now,
+			CreatedBy: strings.Join(s.command, " "),
+			Comment:   comment,
+		}),
+		Created: now,
+	}
+	return img, storeImage(img)
+}
+
+func newCommitCommand() *cobra.Command {
+	var comment string
+	cmd := &cobra.Command{
+		Use:   "commit SANDBOX NAME",
+		Short: "Store the writable layer of a sandbox as a new image",
+		Args:  ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			s, err := loadOverlaySandbox(args[0])
+			if err != nil {
+				return err
+			}
+			img, err := commitSandbox(s, args[1], comment)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), img.Name)
+			return nil
+		},
+	}
+	cmd.Flags().StringVarP(&comment, "message", "m", "", "Comment recorded in the image history")
+	return cmd
+}
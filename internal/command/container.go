@@ -1,11 +1,10 @@
 package command
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"os"
-	"os/user"
 	"path/filepath"
-	"strconv"
 
 	securejoin "github.com/cyphar/filepath-securejoin"
 
@@ -17,103 +16,159 @@ import (
 	"github.com/pkg/errors"
 )
 
+const (
+	stateRoot          = "/var/lib/sandbox"
+	containerStateRoot = stateRoot + "/containerd"
+)
+
+// defaultMaskedPaths are hidden in every sandbox unless replaceMaskedPaths is set
+var defaultMaskedPaths = []string{
+	"/proc/acpi",
+	"/proc/asound",
+	"/proc/kcore",
+	"/proc/keys",
+	"/proc/latency_stats",
+	"/proc/timer_list",
+	"/proc/timer_stats",
+	"/proc/sched_debug",
+	"/sys/firmware",
+	"/proc/scsi",
+}
+
+// maskedPaths returns the paths to overmount with /dev/null or an empty read-only tmpfs
+func maskedPaths(c specConfig) []string {
+	paths := []string{}
+	if !c.ReplaceMaskedPaths {
+		paths = append(paths, defaultMaskedPaths...)
+	}
+	paths = append(paths, c.MaskedPaths...)
+	return RemoveDuplicateElement(append(paths, c.HiddenPaths...))
+}
+
 //InitSandboxConfig init config
-func InitSandboxConfig(id string, options execOptions) (*specs.Spec, *configs.Config, error) {
+func InitSandboxConfig(id string, options *execOptions) (*specs.Spec, *configs.Config, error) {
 
-	u, err := user.Lookup(options.user)
-	if err != nil {
-		return nil, nil, errors.WithStack(err)
+	userName := options.user
+	args := options.command
+	var imageEnv []string
+	imageDir := ""
+	var lowerDirs []string
+	if img := options.resolvedImage; img != nil {
+		if !options.userChanged && img.Config.User != "" {
+			userName = img.Config.User
+		}
+		cmd := img.Config.Cmd
+		if len(args) > 0 {
+			cmd = args
+		}
+		args = append(append([]string{}, img.Config.Entrypoint...), cmd...)
+		imageEnv = img.Config.Env
+		imageDir = defaultImageWorkingDir
+		if img.Config.WorkingDir != "" {
+			imageDir = img.Config.WorkingDir
+		}
+		var err error
+		if lowerDirs, err = img.lowerDirs(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(args) == 0 && !options.login {
+		if options.resolvedImage == nil {
+			return nil, nil, errors.New("no command given")
+		}
+		return nil, nil, errors.New("no command given and the image does not define one")
 	}
 
-	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	u, err := resolveUser(options.specConfig, lowerDirs, userName, options.specConfig.GroupAdd)
 	if err != nil {
 		return nil, nil, errors.WithStack(err)
 	}
-	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if options.login {
+		// a login session starts in the home directory, with the user's shell
+		args = loginArgs(u.Shell, options.command)
+		imageDir = u.Home
+	}
+	options.homeDir = u.Home
+	cwd, err := workingDir(options.specConfig, imageDir)
 	if err != nil {
 		return nil, nil, errors.WithStack(err)
 	}
+	// later sources win: host passthrough, user, image, the real terminal,
+	// explicit variables and forwarded sockets
+	env := mergeEnv([]string{"PATH=" + defaultPath},
+		hostEnv(options.specConfig.Env),
+		u.env(),
+		imageEnv,
+		terminalEnv(),
+		options.specConfig.Env.Vars,
+		socketEnv(options.specConfig))
+	env = append(env, "SANDBOX_ID="+id)
 
-	specMount := []specs.Mount{
-		{
-			Destination: "/",
-			Type:        "rbind",
-			Source:      "/",
-			Options:     []string{"rbind", "rw", "private"},
-		},
-		{
-			Destination: "/dev",
-			Type:        "tmpfs",
-			Source:      "tmpfs",
-			Options:     []string{"nosuid", "strictatime", "mode=755", "size=65536k"},
-		},
-		{
-			Destination: "/dev/pts",
-			Type:        "devpts",
-			Source:      "devpts",
-			Options:     []string{"nosuid", "noexec", "newinstance", "ptmxmode=0666", "mode=0620", "gid=5"},
-		},
-		{
-			Destination: "/dev/shm",
-			Type:        "tmpfs",
-			Source:      "shm",
-			Options:     []string{"nosuid", "noexec", "nodev", "mode=1777", "size=65536k"},
-		},
-		{
-			Destination: "/dev/mqueue",
-			Type:        "mqueue",
-			Source:      "mqueue",
-			Options:     []string{"nosuid", "noexec", "nodev"},
-		},
+	specMount := append(rootMounts(filepath.Join(containerStateRoot, id), options.specConfig, lowerDirs),
+		sandboxBuiltinMounts(options.specConfig)...)
+
+	specMount = append(specMount, tmpMounts(options.specConfig)...)
+	home, err := homeMounts(options.specConfig, lowerDirs, u.homeName(), u.Home, u.UID, u.GID)
+	if err != nil {
+		return nil, nil, err
+	}
+	specMount = append(specMount, home...)
+	specMount = append(specMount, etcMounts(filepath.Join(containerStateRoot, id), options.specConfig)...)
+	specMount = append(specMount, secretMounts(filepath.Join(containerStateRoot, id), options.specConfig)...)
+	specMount = append(specMount, socketMounts(options.specConfig)...)
+	specMount = append(specMount, options.specConfig.Mounts...)
+	specMount = append(specMount, writableMounts(options.specConfig)...)
+
+	readonlyPaths := append([]string{
+		"/proc/bus",
+		"/proc/fs",
+		"/proc/irq",
+		"/proc/sys",
+		"/proc/sysrq-trigger",
+	}, options.specConfig.Ropath...)
+	if options.specConfig.ReadonlyRoot {
+		submounts, err := readonlySubmounts(options.specConfig)
+		if err != nil {
+			return nil, nil, err
+		}
+		readonlyPaths = append(readonlyPaths, submounts...)
+	}
+
+	devices, deviceRules, err := linuxDevices(options.specConfig)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	spec := &specs.Spec{
 		Version: specs.Version,
 		Root: &specs.Root{
-			Path:     "/tmp",
-			Readonly: false,
+			Path:     stagingDir(id),
+			Readonly: options.specConfig.ReadonlyRoot,
 		},
 		Process: &specs.Process{
 			Terminal: true,
 			User: specs.User{
-				UID: uint32(uid),
-				GID: uint32(gid),
+				UID:            uint32(u.UID),
+				GID:            uint32(u.GID),
+				AdditionalGids: additionalGids(u.Gids),
 			},
-			Args:            options.command,
-			Env:             []string{"PATH=/usr/local/bin:/usr/local/sbin:/usr/bin:/usr/sbin:/bin:/sbin", "TERM=xterm"},
-			Cwd:             "/tmp",
-			NoNewPrivileges: false,
+			Args:            args,
+			Env:             env,
+			Cwd:             cwd,
+			NoNewPrivileges: *options.specConfig.NoNewPrivileges,
 			Capabilities:    &options.specConfig.Capabilities,
-			Rlimits: []specs.POSIXRlimit{
-				{
-					Type: "RLIMIT_NOFILE",
-					Hard: uint64(1024),
-					Soft: uint64(1024),
-				},
-			},
+			Rlimits:         options.specConfig.Rlimits,
 		},
 		Hostname: "",
 		Mounts:   specMount,
 		Linux: &specs.Linux{
-			MaskedPaths: []string{
-				"/proc/acpi",
-				"/proc/asound",
-				"/proc/kcore",
-				"/proc/keys",
-				"/proc/latency_stats",
-				"/proc/timer_list",
-				"/proc/timer_stats",
-				"/proc/sched_Sandbox",
-				"/sys/firmware",
-				"/proc/scsi",
+			RootfsPropagation: nsPropagation(options.specConfig),
+			MaskedPaths:       maskedPaths(options.specConfig),
+			ReadonlyPaths:     readonlyPaths,
+			Devices:           devices,
+			Resources: &specs.LinuxResources{
+				Devices: deviceRules,
 			},
-			ReadonlyPaths: append([]string{
-				"/proc/bus",
-				"/proc/fs",
-				"/proc/irq",
-				"/proc/sys",
-				"/proc/sysrq-trigger",
-			}, options.specConfig.Ropath...),
 			Namespaces: []specs.LinuxNamespace{
 				{
 					Type: specs.MountNamespace,
@@ -141,14 +196,14 @@ func InitSandboxConfig(id string, options execOptions) (*specs.Spec, *configs.Co
 // loadFactory returns the configured factory instance for execing containers.
 func (cli *SandboxCli) loadFactory() (libcontainer.Factory, error) {
 
-	return libcontainer.New("/var/lib/sandbox/containerd", libcontainer.Cgroupfs, libcontainer.InitArgs(os.Args[0], "init"))
+	return libcontainer.New(containerStateRoot, libcontainer.Cgroupfs, libcontainer.InitArgs(os.Args[0], "init"))
 }
 
 //CreateSandboxContainer instabce of create Sandbox container
 func (cli *SandboxCli) CreateSandboxContainer(options execOptions) (*specs.Spec, libcontainer.Container, error) {
 
 	containerID := stringid.GenerateRandomID()
-	spec, config, err := InitSandboxConfig(containerID, options)
+	spec, config, err := InitSandboxConfig(containerID, &options)
 	if err != nil {
 		return nil, nil, errors.WithStack(err)
 	}
@@ -158,34 +213,105 @@ func (cli *SandboxCli) CreateSandboxContainer(options execOptions) (*specs.Spec,
 		return nil, nil, errors.WithStack(err)
 	}
 
+	// the staging dir itself becomes the mode of a tmpfs root, the parent
+	// keeps other users out
+	if err = os.MkdirAll(rootfsStaging, 0700); err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	if err = os.Mkdir(stagingDir(containerID), 0755); err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
 	//return container status stopped
 	container, err := factory.Create(containerID, config)
 	if err != nil {
-		container.Destroy()
+		os.Remove(stagingDir(containerID))
 		return nil, nil, errors.WithStack(err)
 	}
 
-	// write config path to containerRoot
-	containerRoot, err := securejoin.SecureJoin("/var/lib/sandbox/containerd", containerID)
-	if err != nil {
+	// everything prepared from here on is released by the cleanup
+	if err = prepareSandbox(containerID, spec, options); err != nil {
+		cli.CleanSandboxContainer(container)
 		return nil, nil, err
 	}
-	absoluteConfigPath, err := filepath.Abs(options.config)
+	return spec, container, nil
+}
+
+// prepareSandbox prepares the root and writes the state the sandbox init
+// reads to the container state dir
+func prepareSandbox(containerID string, spec *specs.Spec, options execOptions) error {
+	containerRoot, err := securejoin.SecureJoin(containerStateRoot, containerID)
 	if err != nil {
-		return nil, nil, err
+		return err
+	}
+	var lowerDirs []string
+	if options.resolvedImage != nil {
+		if lowerDirs, err = options.resolvedImage.lowerDirs(); err != nil {
+			return err
+		}
+	}
+	err = prepareRootfs(containerRoot, options.specConfig, lowerDirs)
+	if err == nil {
+		err = prepareEtc(containerRoot, options.specConfig, lowerDirs)
+	}
+	if err == nil {
+		err = prepareSecrets(containerRoot, options.specConfig, lowerDirs)
+	}
+	if err == nil {
+		err = prepareHome(containerRoot, options.specConfig, lowerDirs, options.homeDir)
 	}
-	err = ioutil.WriteFile(containerRoot+"/config", []byte(absoluteConfigPath), 0644)
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
-	return spec, container, nil
+	// write the resolved config to containerRoot for the init process
+	secretOwners(&options.specConfig, int(spec.Process.User.UID), int(spec.Process.User.GID))
+	resolvedConfig, err := json.Marshal(options.specConfig)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(containerRoot+"/config", resolvedConfig, 0600)
+	if err != nil {
+		return err
+	}
+	command, err := json.Marshal(spec.Process.Args)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(containerRoot+"/command", command, 0600)
+	if err != nil {
+		return err
+	}
+	if options.resolvedImage != nil {
+		resolvedImage, err := json.Marshal(options.resolvedImage)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(containerRoot+"/image.json", resolvedImage, 0600)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 //CleanSandboxContainer clean all Sandbox container
 func (cli *SandboxCli) CleanSandboxContainer(c libcontainer.Container) error {
-	err := c.Destroy()
+	if err := releaseLayer(filepath.Join(containerStateRoot, c.ID()), cli.Err()); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := releaseEtc(filepath.Join(containerStateRoot, c.ID())); err != nil {
+		return errors.WithStack(err)
+	}
+	mountpoints, err := releaseMountpoints(filepath.Join(containerStateRoot, c.ID()))
 	if err != nil {
 		return errors.WithStack(err)
 	}
+	if err = c.Destroy(); err != nil {
+		return errors.WithStack(err)
+	}
+	removeMountpoints(mountpoints)
+	// the mount namespace is gone, only the empty mountpoint is left
+	if err = os.Remove(stagingDir(c.ID())); err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
 	return nil
 }
@@ -0,0 +1,139 @@
+package command
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/opencontainers/runc/libcontainer/devices"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+const defaultDevicePermissions = "rwm"
+
+// deviceConfig is a host device made available in the sandbox
+type deviceConfig struct {
+	Path          string `json:"path"`
+	ContainerPath string `json:"containerPath"`
+	Permissions   string `json:"permissions"`
+}
+
+// parseDevice parses a --device value of the form host[:container][:rwm]
+func parseDevice(val string) (deviceConfig, error) {
+	parts := strings.Split(val, ":")
+	d := deviceConfig{Path: parts[0]}
+	switch len(parts) {
+	case 1:
+	case 2:
+		if isDevicePermissions(parts[1]) {
+			d.Permissions = parts[1]
+		} else {
+			d.ContainerPath = parts[1]
+		}
+	case 3:
+		d.ContainerPath = parts[1]
+		d.Permissions = parts[2]
+	default:
+		return d, fmt.Errorf("invalid device %q, expected host[:container][:rwm]", val)
+	}
+	return d, nil
+}
+
+// isDevicePermissions reports whether s is a combination of r, w and m
+func isDevicePermissions(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !strings.ContainsRune(defaultDevicePermissions, c) || strings.Count(s, string(c)) > 1 {
+			return false
+		}
+	}
+	return true
+}
+
+// validateDevices checks the configured devices exist on the host and fills
+// in the defaults
+func validateDevices(c *specConfig) error {
+	for i := range c.Devices {
+		d := &c.Devices[i]
+		if !filepath.IsAbs(d.Path) {
+			return fmt.Errorf("device %q is not absolute", d.Path)
+		}
+		if d.ContainerPath == "" {
+			d.ContainerPath = d.Path
+		}
+		if !filepath.IsAbs(d.ContainerPath) {
+			return fmt.Errorf("device %s: container path %q is not absolute", d.Path, d.ContainerPath)
+		}
+		d.ContainerPath = filepath.Clean(d.ContainerPath)
+		// only /dev is a tmpfs of the sandbox, a node elsewhere would be created in the root
+		if d.ContainerPath == "/dev" || !underAny(d.ContainerPath, []string{"/dev"}) {
+			return fmt.Errorf("device %s: container path %s is not below /dev", d.Path, d.ContainerPath)
+		}
+		if d.Permissions == "" {
+			d.Permissions = defaultDevicePermissions
+		}
+		if !isDevicePermissions(d.Permissions) {
+			return fmt.Errorf("device %s: invalid permissions %q, expected a combination of r, w and m", d.Path, d.Permissions)
+		}
+		if _, err := hostDevice(*d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hostDevice looks up a configured device on the host
+func hostDevice(d deviceConfig) (*devices.Device, error) {
+	dev, err := devices.DeviceFromPath(d.Path, d.Permissions)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("device %s does not exist", d.Path)
+		}
+		if err == devices.ErrNotADevice {
+			return nil, fmt.Errorf("%s is not a device", d.Path)
+		}
+		return nil, fmt.Errorf("device %s: %w", d.Path, err)
+	}
+	if dev.Type != devices.CharDevice && dev.Type != devices.BlockDevice {
+		return nil, fmt.Errorf("%s is not a block or character device", d.Path)
+	}
+	return dev, nil
+}
+
+// linuxDevices returns the device nodes to create in the sandbox and the
+// cgroup rules allowing them
+func linuxDevices(c specConfig) ([]specs.LinuxDevice, []specs.LinuxDeviceCgroup, error) {
+	var (
+		nodes []specs.LinuxDevice
+		rules []specs.LinuxDeviceCgroup
+	)
+	for _, d := range c.Devices {
+		dev, err := hostDevice(d)
+		if err != nil {
+			return nil, nil, err
+		}
+		mode := dev.FileMode
+		uid, gid := dev.Uid, dev.Gid
+		nodes = append(nodes, specs.LinuxDevice{
+			Path:     d.ContainerPath,
+			Type:     string(dev.Type),
+			Major:    dev.Major,
+			Minor:    dev.Minor,
+			FileMode: &mode,
+			UID:      &uid,
+			GID:      &gid,
+		})
+		major, minor := dev.Major, dev.Minor
+		rules = append(rules, specs.LinuxDeviceCgroup{
+			Allow:  true,
+			Type:   string(dev.Type),
+			Major:  &major,
+			Minor:  &minor,
+			Access: d.Permissions,
+		})
+	}
+	return nodes, rules, nil
+}
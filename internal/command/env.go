@@ -0,0 +1,135 @@
+package command
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const defaultPath = "/usr/local/bin:/usr/local/sbin:/usr/bin:/usr/sbin:/bin:/sbin"
+
+// sensitiveEnv are never passed through from the host, whatever the
+// passthrough patterns. They are matched regardless of case.
+var sensitiveEnv = []string{
+	"*TOKEN*",
+	"*SECRET*",
+	"*PASSWORD*",
+	"*PASSWD*",
+	"*CREDENTIAL*",
+	"*_KEY",
+	"*_KEY_ID",
+	"AWS_*",
+	"SSH_AUTH_SOCK",
+	"SSH_AGENT_PID",
+	"GPG_AGENT_INFO",
+	"KRB5CCNAME",
+	"VAULT_*",
+	"LD_*",
+	"SUDO_*",
+	"DBUS_SESSION_BUS_ADDRESS",
+	"XAUTHORITY",
+}
+
+// envConfig controls the environment of the sandbox process
+type envConfig struct {
+	// Passthrough are patterns of host variables passed to the sandbox
+	Passthrough []string `json:"passthrough"`
+	// Deny are patterns of host variables never passed, on top of sensitiveEnv
+	Deny []string `json:"deny"`
+	// Vars are KEY=VAL set in the sandbox, from the config, --env-file and -e
+	Vars []string `json:"vars"`
+}
+
+// parseEnv parses a -e or --env-file entry, KEY=VAL or KEY for the value of
+// the host variable. ok is false for a KEY that is not set on the host.
+func parseEnv(val string) (kv string, ok bool, err error) {
+	name := envName(val)
+	if !envNamePattern.MatchString(name) {
+		return "", false, fmt.Errorf("invalid variable %q, expected KEY=VAL or KEY", val)
+	}
+	if strings.Contains(val, "=") {
+		return val, true, nil
+	}
+	value, ok := os.LookupEnv(name)
+	return name + "=" + value, ok, nil
+}
+
+// readEnvFile reads a file of KEY=VAL or KEY lines, skipping empty lines and
+// # comments
+func readEnvFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var vars []string
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimLeft(s.Text(), " \t")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv, ok, err := parseEnv(line)
+		if err != nil {
+			return nil, fmt.Errorf("env file %s, line %d: %w", path, n, err)
+		}
+		if ok {
+			vars = append(vars, kv)
+		}
+	}
+	return vars, s.Err()
+}
+
+// validateEnv checks the patterns and variables of the env section
+func validateEnv(c *specConfig) error {
+	for _, pattern := range append(append([]string{}, c.Env.Passthrough...), c.Env.Deny...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("env: invalid pattern %q", pattern)
+		}
+	}
+	for _, kv := range c.Env.Vars {
+		if !strings.Contains(kv, "=") || !envNamePattern.MatchString(envName(kv)) {
+			return fmt.Errorf("env: invalid variable %q, expected KEY=VAL", kv)
+		}
+	}
+	return nil
+}
+
+// matchEnv reports whether the variable name matches any of the patterns
+func matchEnv(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// hostEnv returns the host variables allowed through to the sandbox
+func hostEnv(c envConfig) []string {
+	if len(c.Passthrough) == 0 {
+		return nil
+	}
+	var env []string
+	for _, kv := range os.Environ() {
+		name := envName(kv)
+		if !matchEnv(c.Passthrough, name) ||
+			matchEnv(c.Deny, name) ||
+			matchEnv(sensitiveEnv, strings.ToUpper(name)) {
+			continue
+		}
+		env = append(env, kv)
+	}
+	return env
+}
+
+// terminalEnv returns TERM of the terminal the sandbox runs on
+func terminalEnv() []string {
+	term := os.Getenv("TERM")
+	if term == "" {
+		term = "xterm"
+	}
+	return []string{"TERM=" + term}
+}
@@ -0,0 +1,343 @@
+package command
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+const defaultHosts = "127.0.0.1\tlocalhost\n::1\tlocalhost ip6-localhost ip6-loopback\n"
+
+var (
+	hostnamePattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9.-]*[a-zA-Z0-9])?$`)
+	userNamePattern = regexp.MustCompile(`^[a-z_][a-z0-9_.-]*\$?$`)
+)
+
+// extraUser is added to the passwd and group files of the sandbox
+type extraUser struct {
+	Name   string   `json:"name"`
+	UID    int      `json:"uid"`
+	GID    int      `json:"gid"`
+	Home   string   `json:"home"`
+	Shell  string   `json:"shell"`
+	Groups []string `json:"groups"`
+}
+
+// etcDir is the per-sandbox tmpfs holding the generated files
+func etcDir(stateDir string) string {
+	return filepath.Join(stateDir, "etc")
+}
+
+// parseAddHost parses an --add-host value of the form name:ip
+func parseAddHost(val string) (string, net.IP, error) {
+	parts := strings.SplitN(val, ":", 2)
+	if len(parts) != 2 || !hostnamePattern.MatchString(parts[0]) {
+		return "", nil, fmt.Errorf("invalid host %q, expected name:ip", val)
+	}
+	ip := net.ParseIP(parts[1])
+	if ip == nil {
+		return "", nil, fmt.Errorf("invalid host %q: %q is not an IP address", val, parts[1])
+	}
+	return parts[0], ip, nil
+}
+
+// validateEtc checks the settings of the generated files
+func validateEtc(c *specConfig) error {
+	for _, val := range c.AddHosts {
+		if _, _, err := parseAddHost(val); err != nil {
+			return err
+		}
+	}
+	for _, dns := range c.DNS {
+		if net.ParseIP(dns) == nil {
+			return fmt.Errorf("invalid dns server %q", dns)
+		}
+	}
+	for _, domain := range c.DNSSearch {
+		if domain != "." && !hostnamePattern.MatchString(domain) {
+			return fmt.Errorf("invalid dns search domain %q", domain)
+		}
+	}
+	names := map[string]struct{}{}
+	for i := range c.ExtraUsers {
+		u := &c.ExtraUsers[i]
+		if !userNamePattern.MatchString(u.Name) {
+			return fmt.Errorf("invalid extra user name %q", u.Name)
+		}
+		if _, ok := names[u.Name]; ok {
+			return fmt.Errorf("extra user %s is defined twice", u.Name)
+		}
+		names[u.Name] = struct{}{}
+		if u.UID < 0 || u.GID < 0 {
+			return fmt.Errorf("extra user %s: invalid uid or gid", u.Name)
+		}
+		if u.Home == "" {
+			u.Home = "/home/" + u.Name
+		}
+		if u.Shell == "" {
+			u.Shell = "/bin/sh"
+		}
+		if !filepath.IsAbs(u.Home) || !filepath.IsAbs(u.Shell) {
+			return fmt.Errorf("extra user %s: home and shell must be absolute", u.Name)
+		}
+		for _, g := range u.Groups {
+			if !userNamePattern.MatchString(g) {
+				return fmt.Errorf("extra user %s: invalid group name %q", u.Name, g)
+			}
+		}
+	}
+	return nil
+}
+
+// etcFiles returns the files of /etc the sandbox gets generated copies of
+func etcFiles(c specConfig) []string {
+	var files []string
+	if len(c.ExtraUsers) > 0 {
+		files = append(files, "passwd", "group")
+	}
+	if len(c.AddHosts) > 0 {
+		files = append(files, "hosts")
+	}
+	if len(c.DNS) > 0 || len(c.DNSSearch) > 0 {
+		files = append(files, "resolv.conf")
+	}
+	return files
+}
+
+// etcMounts binds the generated files over those of the root
+func etcMounts(stateDir string, c specConfig) []specs.Mount {
+	var mounts []specs.Mount
+	for _, name := range etcFiles(c) {
+		mounts = append(mounts, specs.Mount{
+			Destination: "/etc/" + name,
+			Type:        "bind",
+			Source:      filepath.Join(etcDir(stateDir), name),
+			Options:     []string{"bind", "ro", "nosuid", "nodev", "noexec", "rprivate"},
+		})
+	}
+	return mounts
+}
+
+// prepareEtc mounts the tmpfs of the generated files and writes them, based on
+// the files of the sandbox root
+func prepareEtc(stateDir string, c specConfig, lowerDirs []string) error {
+	files := etcFiles(c)
+	if len(files) == 0 {
+		return nil
+	}
+	dir := etcDir(stateDir)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+	if err := unix.Mount("tmpfs", dir, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, "size=1m,mode=755"); err != nil {
+		return fmt.Errorf("mount %s: %w", dir, err)
+	}
+	for _, name := range files {
+		base, err := rootFile(c, lowerDirs, "/etc/"+name)
+		if err != nil {
+			return err
+		}
+		var data []byte
+		switch name {
+		case "passwd":
+			data, err = generatePasswd(base, c.ExtraUsers)
+		case "group":
+			data, err = generateGroup(base, c.ExtraUsers)
+		case "hosts":
+			data, err = generateHosts(base, c.AddHosts)
+		case "resolv.conf":
+			data = generateResolvConf(base, c.DNS, c.DNSSearch)
+		}
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseEtc unmounts the tmpfs of the generated files before the state dir
+// is removed
+func releaseEtc(stateDir string) error {
+	return unmountDir(etcDir(stateDir))
+}
+
+// rootFile reads a file as the sandbox sees it, nil if it does not exist. An
+// image is resolved through its layers, an allowlist root only has the
+// included host paths.
+func rootFile(c specConfig, lowerDirs []string, path string) ([]byte, error) {
+	if len(c.Rootfs.Include) > 0 && !underAny(path, c.Rootfs.Include) {
+		return nil, nil
+	}
+	layer, fi, err := lookupLayers(rootLayers(c, lowerDirs), path)
+	if err != nil || fi == nil {
+		return nil, err
+	}
+	// a symlink is only followed within its layer
+	p, err := securejoin.SecureJoin(layer, path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// rootLayers returns the directories the sandbox root is built from, the top
+// one first
+func rootLayers(c specConfig, lowerDirs []string) []string {
+	if len(lowerDirs) > 0 {
+		return lowerDirs
+	}
+	if c.Rootfs.Path != "" {
+		return []string{c.Rootfs.Path}
+	}
+	return []string{"/"}
+}
+
+// withNewline terminates non-empty file contents with a newline
+func withNewline(data []byte) []byte {
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		data = append(data, '\n')
+	}
+	return data
+}
+
+// fileFields returns the first field of every line of a colon separated file
+func fileFields(data []byte) map[string]struct{} {
+	names := map[string]struct{}{}
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		if name := strings.SplitN(s.Text(), ":", 2)[0]; name != "" {
+			names[name] = struct{}{}
+		}
+	}
+	return names
+}
+
+func generatePasswd(base []byte, users []extraUser) ([]byte, error) {
+	existing := fileFields(base)
+	buf := bytes.NewBuffer(withNewline(append([]byte{}, base...)))
+	for _, u := range users {
+		if _, ok := existing[u.Name]; ok {
+			return nil, fmt.Errorf("extra user %s already exists in the sandbox root", u.Name)
+		}
+		fmt.Fprintf(buf, "%s:x:%d:%d::%s:%s\n", u.Name, u.UID, u.GID, u.Home, u.Shell)
+	}
+	return buf.Bytes(), nil
+}
+
+// generateGroup adds a primary group for every extra user whose gid has none
+// and adds the users to their supplementary groups
+func generateGroup(base []byte, users []extraUser) ([]byte, error) {
+	type group struct {
+		fields  []string
+		members []string
+	}
+	var groups []*group
+	byName := map[string]*group{}
+	gids := map[string]struct{}{}
+	s := bufio.NewScanner(bytes.NewReader(base))
+	for s.Scan() {
+		fields := strings.Split(s.Text(), ":")
+		g := &group{fields: fields}
+		groups = append(groups, g)
+		if len(fields) < 4 {
+			continue
+		}
+		if fields[3] != "" {
+			g.members = strings.Split(fields[3], ",")
+		}
+		byName[fields[0]] = g
+		gids[fields[2]] = struct{}{}
+	}
+
+	for _, u := range users {
+		gid := strconv.Itoa(u.GID)
+		if _, ok := gids[gid]; !ok {
+			if _, ok := byName[u.Name]; ok {
+				return nil, fmt.Errorf("extra user %s: group %s exists with another gid", u.Name, u.Name)
+			}
+			g := &group{fields: []string{u.Name, "x", gid, ""}}
+			groups = append(groups, g)
+			byName[u.Name] = g
+			gids[gid] = struct{}{}
+		}
+		for _, name := range u.Groups {
+			g, ok := byName[name]
+			if !ok {
+				return nil, fmt.Errorf("extra user %s: no such group %s in the sandbox root", u.Name, name)
+			}
+			g.members = append(g.members, u.Name)
+		}
+	}
+
+	var buf bytes.Buffer
+	for _, g := range groups {
+		if len(g.fields) >= 4 {
+			g.fields[3] = strings.Join(g.members, ",")
+		}
+		buf.WriteString(strings.Join(g.fields, ":") + "\n")
+	}
+	return buf.Bytes(), nil
+}
+
+func generateHosts(base []byte, addHosts []string) ([]byte, error) {
+	if len(base) == 0 {
+		base = []byte(defaultHosts)
+	}
+	buf := bytes.NewBuffer(withNewline(append([]byte{}, base...)))
+	for _, val := range addHosts {
+		name, ip, err := parseAddHost(val)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(buf, "%s\t%s\n", ip, name)
+	}
+	return buf.Bytes(), nil
+}
+
+// generateResolvConf replaces the name servers and search domains of the
+// root's resolv.conf and keeps its other settings
+func generateResolvConf(base []byte, dns, search []string) []byte {
+	var buf bytes.Buffer
+	s := bufio.NewScanner(bytes.NewReader(base))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) > 0 {
+			switch fields[0] {
+			case "nameserver":
+				if len(dns) > 0 {
+					continue
+				}
+			case "search", "domain":
+				if len(search) > 0 {
+					continue
+				}
+			}
+		}
+		buf.WriteString(s.Text() + "\n")
+	}
+	for _, server := range dns {
+		fmt.Fprintf(&buf, "nameserver %s\n", server)
+	}
+	if len(search) > 0 {
+		fmt.Fprintf(&buf, "search %s\n", strings.Join(search, " "))
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,63 @@
+package command
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/moby/sys/mountinfo"
+)
+
+// checkHiddenPaths verifies that every unmount path is a mount point and that
+// every hidden path exists in the sandbox root. In strict mode a failed check
+// aborts startup, otherwise it is reported as a warning.
+func checkHiddenPaths(c specConfig, lowerDirs []string, warn io.Writer) error {
+	for _, path := range append(append([]string{}, c.UnmountPaths...), c.HiddenPaths...) {
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("unmount or hidden path %q is not absolute", path)
+		}
+	}
+	report := func(err error) error {
+		if c.Strict {
+			return err
+		}
+		fmt.Fprintf(warn, "WARNING: %v\n", err)
+		return nil
+	}
+	// unmount paths refer to the host root
+	for _, path := range c.UnmountPaths {
+		if !c.Rootfs.hostRoot() {
+			break
+		}
+		mounted, err := mountinfo.Mounted(path)
+		if err != nil {
+			mounted = false
+		}
+		if !mounted {
+			if err := report(fmt.Errorf("unmount path %q is not a mount point and stays visible, use hiddenPaths instead", path)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, path := range c.HiddenPaths {
+		var err error
+		switch {
+		case len(c.Rootfs.Include) > 0 && !underAny(path, c.Rootfs.Include):
+			err = os.ErrNotExist
+		case len(c.Rootfs.Include) > 0:
+			_, err = os.Lstat(path)
+		default:
+			var fi os.FileInfo
+			if _, fi, err = lookupLayers(rootLayers(c, lowerDirs), path); err == nil && fi == nil {
+				err = os.ErrNotExist
+			}
+		}
+		if err != nil {
+			if err := report(fmt.Errorf("hidden path %q: %w", path, err)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
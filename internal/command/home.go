@@ -0,0 +1,177 @@
+package command
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+const (
+	homeModeHost       = "host"
+	homeModeTmpfs      = "tmpfs"
+	homeModePersistent = "persistent"
+
+	skelDir = "/etc/skel"
+)
+
+// homeRoot holds the persistent home directory of each user
+var homeRoot = filepath.Join(stateRoot, "homes")
+
+func validateHomeMode(c *specConfig) error {
+	switch c.Home {
+	case "":
+		c.Home = homeModeHost
+	case homeModeHost, homeModeTmpfs, homeModePersistent:
+	default:
+		return fmt.Errorf("invalid home mode %q, expected host, tmpfs or persistent", c.Home)
+	}
+	return nil
+}
+
+// homeMounts returns the mount on the home directory of the sandbox user.
+// The root's own home directory is used in host mode.
+func homeMounts(c specConfig, lowerDirs []string, name, home string, uid, gid int) ([]specs.Mount, error) {
+	if c.Home == homeModeHost {
+		return nil, nil
+	}
+	if !filepath.IsAbs(home) || filepath.Clean(home) == "/" {
+		return nil, fmt.Errorf("user %s has no home directory to mount", name)
+	}
+	m := specs.Mount{Destination: filepath.Clean(home)}
+	switch c.Home {
+	case homeModeTmpfs:
+		m.Type = "tmpfs"
+		m.Source = "tmpfs"
+		m.Options = []string{"nosuid", "nodev", "mode=700", "uid=" + strconv.Itoa(uid), "gid=" + strconv.Itoa(gid)}
+	case homeModePersistent:
+		dir, err := persistentHome(c, lowerDirs, name, uid, gid)
+		if err != nil {
+			return nil, err
+		}
+		m.Type = "bind"
+		m.Source = dir
+		m.Options = []string{"rbind", "rw", "nosuid", "nodev", "rprivate"}
+	}
+	return []specs.Mount{m}, nil
+}
+
+// prepareHome creates the mountpoint of a tmpfs or persistent home directory
+// missing from the root
+func prepareHome(stateDir string, c specConfig, lowerDirs []string, home string) error {
+	if c.Home == homeModeHost {
+		return nil
+	}
+	return prepareMountpoint(stateDir, c, lowerDirs, filepath.Clean(home))
+}
+
+// persistentHome returns the persistent home directory of a user, creating
+// it from the skeleton files of the root on first use. It is kept per name
+// and uid, as images may give the same name different uids.
+func persistentHome(c specConfig, lowerDirs []string, name string, uid, gid int) (string, error) {
+	dir := filepath.Join(homeRoot, url.PathEscape(name)+"-"+strconv.Itoa(uid))
+	if _, err := os.Stat(dir); err == nil || !os.IsNotExist(err) {
+		return dir, err
+	}
+	if err := os.MkdirAll(homeRoot, 0700); err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempDir(homeRoot, ".tmp-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+	if len(c.Rootfs.Include) == 0 || underAny(skelDir, c.Rootfs.Include) {
+		roots := rootLayers(c, lowerDirs)
+		if _, fi, err := lookupLayers(roots, skelDir); err != nil {
+			return "", err
+		} else if fi != nil && fi.IsDir() {
+			if err := copySkel(roots, skelDir, tmp, uid, gid); err != nil {
+				return "", err
+			}
+		}
+	}
+	if err := os.Chmod(tmp, 0700); err != nil {
+		return "", err
+	}
+	if err := os.Chown(tmp, uid, gid); err != nil {
+		return "", err
+	}
+	return dir, os.Rename(tmp, dir)
+}
+
+// copySkel copies a skeleton directory of the root, resolved through its
+// layers, into a new home directory owned by uid:gid
+func copySkel(roots []string, src, dst string, uid, gid int) error {
+	names, err := layerNames(roots, src)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		path := filepath.Join(src, name)
+		layer, fi, err := lookupLayers(roots, path)
+		if err != nil {
+			return err
+		}
+		if fi == nil {
+			continue
+		}
+		// only the parents are resolved, within the layer
+		parent, err := securejoin.SecureJoin(layer, src)
+		if err != nil {
+			return err
+		}
+		source := filepath.Join(parent, name)
+		target := filepath.Join(dst, name)
+		switch {
+		case fi.IsDir():
+			if err := os.Mkdir(target, fi.Mode().Perm()); err != nil {
+				return err
+			}
+			if err := copySkel(roots, path, target, uid, gid); err != nil {
+				return err
+			}
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(source)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+		case fi.Mode().IsRegular():
+			if err := copyFile(source, target, fi.Mode().Perm()); err != nil {
+				return err
+			}
+		default:
+			continue
+		}
+		if err := os.Lchown(target, uid, gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,272 @@
+package command
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const (
+	mediaTypeOCIIndex      = "application/vnd.oci.image.index.v1+json"
+	mediaTypeDockerList    = "application/vnd.docker.distribution.manifest.list.v2+json"
+	annotationRefName      = "org.opencontainers.image.ref.name"
+	defaultImageWorkingDir = "/"
+)
+
+// imageConfig is the part of the OCI image config merged with the CLI options
+type imageConfig struct {
+	User       string   `json:"User,omitempty"`
+	Env        []string `json:"Env,omitempty"`
+	Entrypoint []string `json:"Entrypoint,omitempty"`
+	Cmd        []string `json:"Cmd,omitempty"`
+	WorkingDir string   `json:"WorkingDir,omitempty"`
+}
+
+// imageHistory records how a layer of an image was created
+type imageHistory struct {
+	Created    *time.Time `json:"created,omitempty"`
+	CreatedBy  string     `json:"created_by,omitempty"`
+	Comment    string     `json:"comment,omitempty"`
+	EmptyLayer bool       `json:"empty_layer,omitempty"`
+}
+
+// image is a root filesystem made of unpacked layers from the layer cache
+type image struct {
+	Name string `json:"name"`
+	// Layers are diff ids, the lowest layer first
+	Layers  []string       `json:"layers"`
+	Config  imageConfig    `json:"config"`
+	History []imageHistory `json:"history,omitempty"`
+	Created time.Time      `json:"created"`
+}
+
+// lowerDirs returns the unpacked layers in overlayfs lowerdir order, the top layer first
+func (img *image) lowerDirs() ([]string, error) {
+	dirs := make([]string, 0, len(img.Layers))
+	for i := len(img.Layers) - 1; i >= 0; i-- {
+		dir, err := layerDir(img.Layers[i])
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(dir); err != nil {
+			return nil, fmt.Errorf("image %s: layer %s is missing from the layer cache", img.Name, img.Layers[i])
+		}
+		dirs = append(dirs, dir)
+	}
+	return dirs, nil
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+	} `json:"platform,omitempty"`
+}
+
+type ociIndex struct {
+	MediaType string          `json:"mediaType"`
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	Config ociDescriptor   `json:"config"`
+	Layers []ociDescriptor `json:"layers"`
+}
+
+type ociImage struct {
+	Config imageConfig `json:"config"`
+	RootFS struct {
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+	History []imageHistory `json:"history,omitempty"`
+}
+
+// resolveImage loads an image of the local store, or an image reference of
+// the form oci-layout-dir[:tag] whose layers are unpacked into the layer cache
+func resolveImage(ref string) (*image, error) {
+	if _, err := os.Stat(imageRecordPath(ref)); err == nil {
+		img, err := loadStoredImage(ref)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := img.lowerDirs(); err != nil {
+			return nil, err
+		}
+		return img, nil
+	}
+	layout, tag := ref, ""
+	if i := strings.LastIndex(ref, ":"); i > 0 {
+		if fi, err := os.Stat(ref[:i]); err == nil && fi.IsDir() {
+			layout, tag = ref[:i], ref[i+1:]
+		}
+	}
+	if _, err := os.Stat(filepath.Join(layout, "oci-layout")); err != nil {
+		return nil, fmt.Errorf("image %s: not in the local store and %s is not an OCI image layout", ref, layout)
+	}
+	return loadOCILayout(layout, tag, ref)
+}
+
+func loadOCILayout(layout, tag, name string) (*image, error) {
+	var index ociIndex
+	if err := readJSONFile(filepath.Join(layout, "index.json"), &index); err != nil {
+		return nil, err
+	}
+	desc, err := findManifest(index.Manifests, tag)
+	if err != nil {
+		return nil, fmt.Errorf("image %s: %w", name, err)
+	}
+	// follow nested indexes down to the manifest for this platform
+	for desc.MediaType == mediaTypeOCIIndex || desc.MediaType == mediaTypeDockerList {
+		var nested ociIndex
+		if err := readBlobJSON(layout, desc.Digest, &nested); err != nil {
+			return nil, err
+		}
+		if desc, err = platformManifest(nested.Manifests); err != nil {
+			return nil, fmt.Errorf("image %s: %w", name, err)
+		}
+	}
+
+	var manifest ociManifest
+	if err := readBlobJSON(layout, desc.Digest, &manifest); err != nil {
+		return nil, err
+	}
+	var config ociImage
+	if err := readBlobJSON(layout, manifest.Config.Digest, &config); err != nil {
+		return nil, err
+	}
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return nil, fmt.Errorf("image %s: config lists %d layers, manifest %d", name, len(config.RootFS.DiffIDs), len(manifest.Layers))
+	}
+
+	img := &image{Name: name, Config: config.Config, History: config.History}
+	for i, layer := range manifest.Layers {
+		diffID := config.RootFS.DiffIDs[i]
+		if !hasLayer(diffID) {
+			blob, err := openBlob(layout, layer.Digest)
+			if err != nil {
+				return nil, err
+			}
+			_, err = unpackLayer(blob, diffID)
+			blob.Close()
+			if err != nil {
+				return nil, fmt.Errorf("image %s: layer %s: %w", name, layer.Digest, err)
+			}
+		}
+		img.Layers = append(img.Layers, diffID)
+	}
+	return img, nil
+}
+
+// findManifest picks the manifest tagged with tag, or the only one if tag is empty
+func findManifest(manifests []ociDescriptor, tag string) (ociDescriptor, error) {
+	if tag == "" {
+		if len(manifests) == 1 {
+			return manifests[0], nil
+		}
+		tag = "latest"
+	}
+	for _, m := range manifests {
+		refName := m.Annotations[annotationRefName]
+		if refName == tag || strings.HasSuffix(refName, ":"+tag) {
+			return m, nil
+		}
+	}
+	return ociDescriptor{}, fmt.Errorf("no manifest tagged %q", tag)
+}
+
+func platformManifest(manifests []ociDescriptor) (ociDescriptor, error) {
+	for _, m := range manifests {
+		if m.Platform != nil && m.Platform.OS == "linux" && m.Platform.Architecture == runtime.GOARCH {
+			return m, nil
+		}
+	}
+	return ociDescriptor{}, fmt.Errorf("no manifest for linux/%s", runtime.GOARCH)
+}
+
+// verifiedBlob checks the digest of a blob once it has been read completely
+type verifiedBlob struct {
+	*os.File
+	digest string
+	hash   hash.Hash
+}
+
+func (b *verifiedBlob) Read(p []byte) (int, error) {
+	n, err := b.File.Read(p)
+	b.hash.Write(p[:n])
+	if err == io.EOF {
+		if sum := "sha256:" + hex.EncodeToString(b.hash.Sum(nil)); sum != b.digest {
+			return n, fmt.Errorf("blob %s has digest %s", b.digest, sum)
+		}
+	}
+	return n, err
+}
+
+func openBlob(layout, digest string) (io.ReadCloser, error) {
+	algo, encoded, err := splitDigest(digest)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filepath.Join(layout, "blobs", algo, encoded))
+	if err != nil {
+		return nil, err
+	}
+	return &verifiedBlob{File: f, digest: digest, hash: sha256.New()}, nil
+}
+
+func readBlobJSON(layout, digest string, v interface{}) error {
+	blob, err := openBlob(layout, digest)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+	data, err := io.ReadAll(blob)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func readJSONFile(path string, v interface{}) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewDecoder(f).Decode(v)
+}
+
+// mergeEnv overrides the variables in base by name
+func mergeEnv(base []string, overrides ...[]string) []string {
+	result := append([]string{}, base...)
+	index := make(map[string]int, len(result))
+	for i, kv := range result {
+		index[envName(kv)] = i
+	}
+	for _, override := range overrides {
+		for _, kv := range override {
+			name := envName(kv)
+			if i, ok := index[name]; ok {
+				result[i] = kv
+				continue
+			}
+			index[name] = len(result)
+			result = append(result, kv)
+		}
+	}
+	return result
+}
+
+func envName(kv string) string {
+	return strings.SplitN(kv, "=", 2)[0]
+}
@@ -6,54 +6,68 @@ import (
 	_ "github.com/opencontainers/runc/libcontainer/nsenter"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sys/unix"
-	"io/ioutil"
 	"os"
 	"runtime"
+	"strconv"
 )
 
 func init() {
 	if len(os.Args) > 1 && os.Args[1] == "init" {
 		runtime.GOMAXPROCS(1)
 		runtime.LockOSThread()
+		// the init has no stderr with a terminal, its errors reach the user
+		// through the log pipe libcontainer forwards
+		if fd, err := strconv.Atoi(os.Getenv("_LIBCONTAINER_LOGPIPE")); err == nil {
+			logrus.SetOutput(os.NewFile(uintptr(fd), "logpipe"))
+			logrus.SetFormatter(new(logrus.JSONFormatter))
+		}
 		unmountPaths()
 		factory, _ := libcontainer.New("")
 		if err := factory.StartInitialization(); err != nil {
-			logrus.Fatal(err)
+			// libcontainer has already handed the error to the sandbox command
+			os.Exit(1)
 		}
 		panic("--this line should have never been executed, congratulations--")
 	}
 }
 
 func unmountPaths() {
-	//make mount point "/" private
-	flag := unix.MS_PRIVATE
-	_ = unix.Mount("", "/", "", uintptr(flag), "")
-	//get the config path
-	containerRoot := os.Getenv("_LIBCONTAINER_STATEDIR")
-	if containerRoot == "" {
-		return
-	}
-	configPath := containerRoot + "/config"
-	file, err := os.Open(configPath)
-	if err != nil {
-		panic(err)
-	}
-
-	defer file.Close()
-	cp, err := ioutil.ReadAll(file)
+	//get the config resolved by the sandbox command
 	var options execOptions
-	cf, err := os.Open(string(cp))
-	if err != nil {
-		panic(err)
+	containerRoot := os.Getenv("_LIBCONTAINER_STATEDIR")
+	if containerRoot != "" {
+		file, err := os.Open(containerRoot + "/config")
+		if err != nil {
+			logrus.Fatalf("sandbox init: %v", err)
+		}
+		err = json.NewDecoder(file).Decode(&options.specConfig)
+		file.Close()
+		if err != nil {
+			logrus.Fatalf("sandbox init: read config: %v", err)
+		}
 	}
-	defer cf.Close()
-	err = json.NewDecoder(cf).Decode(&options.specConfig)
-	if err != nil {
-		panic(err)
+	//keep the unmounts below from propagating to the host
+	if options.specConfig.AllowSharedMounts {
+		// shared mounts need the host peer groups below /
+		_ = unix.Mount("", "/", "", unix.MS_PRIVATE, "")
+	} else {
+		_ = unix.Mount("", "/", "", unix.MS_SLAVE|unix.MS_REC, "")
 	}
 	// execute unmount
 	for _, unmountPath := range options.specConfig.UnmountPaths {
-		_ = unix.Unmount(unmountPath, 0)
+		if options.specConfig.AllowSharedMounts {
+			_ = unix.Mount("", unmountPath, "", unix.MS_SLAVE|unix.MS_REC, "")
+		}
+		err := unix.Unmount(unmountPath, 0)
+		if err != nil && options.specConfig.Strict {
+			logrus.Fatalf("strict: unable to unmount %s: %v", unmountPath, err)
+		}
+	}
+	if err := remountNosuidSubmounts(options.specConfig); err != nil {
+		logrus.Fatalf("sandbox init: %v", err)
+	}
+	if err := setupSecrets(containerRoot, options.specConfig); err != nil {
+		logrus.Fatalf("sandbox init: secrets: %v", err)
 	}
 
 }
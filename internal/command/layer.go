@@ -0,0 +1,439 @@
+package command
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = whiteoutPrefix + whiteoutPrefix + ".opq"
+)
+
+// whiteoutFormat selects how the whiteout entries of a layer are applied
+type whiteoutFormat int
+
+const (
+	// whiteoutRemove deletes the files a whiteout refers to
+	whiteoutRemove whiteoutFormat = iota
+	// whiteoutOverlay records whiteouts the way overlayfs expects them in a lower dir
+	whiteoutOverlay
+)
+
+// extractLayer applies an OCI layer tarball to root. If filter is not nil
+// only the entries it accepts are applied.
+func extractLayer(r io.Reader, root string, format whiteoutFormat, filter func(path string) bool) error {
+	type dirTimes struct {
+		path  string
+		mtime time.Time
+	}
+	var dirs []dirTimes
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.Clean("/" + hdr.Name)
+		if name == "/" {
+			continue
+		}
+		dir, base := filepath.Split(name)
+
+		if base == whiteoutOpaque {
+			if filter != nil && !filter(filepath.Clean(dir)) {
+				continue
+			}
+			// an opaque root would empty the whole tree changes are applied to
+			if format == whiteoutRemove && filepath.Clean(dir) == "/" {
+				return fmt.Errorf("invalid opaque whiteout of the root %q", hdr.Name)
+			}
+			parent, err := securejoin.SecureJoin(root, dir)
+			if err != nil {
+				return err
+			}
+			if format == whiteoutOverlay {
+				if err := os.MkdirAll(parent, 0755); err != nil {
+					return err
+				}
+				if err := unix.Lsetxattr(parent, "trusted.overlay.opaque", []byte("y"), 0); err != nil {
+					return fmt.Errorf("mark %s opaque: %w", dir, err)
+				}
+				continue
+			}
+			if err := removeChildren(parent); err != nil {
+				return err
+			}
+			continue
+		}
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			whiteout, err := whiteoutName(base)
+			if err != nil {
+				return err
+			}
+			removed := filepath.Join(dir, whiteout)
+			if filter != nil && !filter(removed) {
+				continue
+			}
+			parent, err := securejoin.SecureJoin(root, dir)
+			if err != nil {
+				return err
+			}
+			path := filepath.Join(parent, whiteout)
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+			if format == whiteoutOverlay {
+				if err := os.MkdirAll(parent, 0755); err != nil {
+					return err
+				}
+				if err := unix.Mknod(path, unix.S_IFCHR, 0); err != nil {
+					return fmt.Errorf("whiteout %s: %w", removed, err)
+				}
+			}
+			continue
+		}
+		if filter != nil && !filter(name) {
+			continue
+		}
+
+		// resolve the parent inside root, but never follow the entry itself
+		parent, err := securejoin.SecureJoin(root, dir)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return err
+		}
+		path := filepath.Join(parent, base)
+		if err := extractEntry(tr, hdr, root, path); err != nil {
+			return fmt.Errorf("extract %s: %w", name, err)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, dirTimes{path: path, mtime: hdr.ModTime})
+		}
+	}
+
+	// directory times are set last, as their content changes them
+	for i := len(dirs) - 1; i >= 0; i-- {
+		_ = os.Chtimes(dirs[i].path, dirs[i].mtime, dirs[i].mtime)
+	}
+	return nil
+}
+
+// whiteoutName returns the name a whiteout entry removes from its directory.
+// Names that would reach outside the directory are refused.
+func whiteoutName(base string) (string, error) {
+	name := strings.TrimPrefix(base, whiteoutPrefix)
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") ||
+		strings.HasPrefix(name, whiteoutPrefix) {
+		return "", fmt.Errorf("invalid whiteout %q", base)
+	}
+	return name, nil
+}
+
+func extractEntry(tr *tar.Reader, hdr *tar.Header, root, path string) error {
+	mode := uint32(hdr.Mode & 07777)
+
+	if fi, err := os.Lstat(path); err == nil && !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(path, os.FileMode(mode)); err != nil && !os.IsExist(err) {
+			return err
+		}
+	case tar.TypeReg, tar.TypeRegA:
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(mode))
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, tr); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, path); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		target, err := securejoin.SecureJoin(root, hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		if err := os.Link(target, path); err != nil {
+			return err
+		}
+		return nil
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		devMode := map[byte]uint32{
+			tar.TypeChar:  unix.S_IFCHR,
+			tar.TypeBlock: unix.S_IFBLK,
+			tar.TypeFifo:  unix.S_IFIFO,
+		}[hdr.Typeflag]
+		dev := unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))
+		if err := unix.Mknod(path, devMode|mode, int(dev)); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported tar entry type %q", hdr.Typeflag)
+	}
+
+	if err := os.Lchown(path, hdr.Uid, hdr.Gid); err != nil {
+		return err
+	}
+	if hdr.Typeflag == tar.TypeSymlink {
+		ts := []unix.Timespec{unix.NsecToTimespec(hdr.ModTime.UnixNano()), unix.NsecToTimespec(hdr.ModTime.UnixNano())}
+		return unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, unix.AT_SYMLINK_NOFOLLOW)
+	}
+	// chown clears the setuid and setgid bits, so the mode is set again
+	if err := os.Chmod(path, fileMode(mode)); err != nil {
+		return err
+	}
+	if hdr.Typeflag != tar.TypeDir {
+		return os.Chtimes(path, hdr.ModTime, hdr.ModTime)
+	}
+	return nil
+}
+
+// fileMode converts unix permission bits to an os.FileMode
+func fileMode(mode uint32) os.FileMode {
+	fm := os.FileMode(mode & 0777)
+	if mode&unix.S_ISUID != 0 {
+		fm |= os.ModeSetuid
+	}
+	if mode&unix.S_ISGID != 0 {
+		fm |= os.ModeSetgid
+	}
+	if mode&unix.S_ISVTX != 0 {
+		fm |= os.ModeSticky
+	}
+	return fm
+}
+
+// removeChildren removes the content of dir but keeps dir itself
+func removeChildren(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookupLayers finds path in overlay layers, the top layer first, the way
+// overlayfs does: a whiteout deletes it, and an opaque directory or a
+// non-directory on its way hides the layers below. It returns the layer
+// holding the path, or an empty string if it does not exist.
+func lookupLayers(dirs []string, path string) (string, os.FileInfo, error) {
+	path = filepath.Clean("/" + path)
+	for _, dir := range dirs {
+		fi, err := os.Lstat(filepath.Join(dir, path))
+		if err == nil {
+			if isWhiteout(fi) {
+				return "", nil, nil
+			}
+			return dir, fi, nil
+		}
+		if !os.IsNotExist(err) && !errors.Is(err, unix.ENOTDIR) {
+			return "", nil, err
+		}
+		if hidesLower(dir, path) {
+			return "", nil, nil
+		}
+	}
+	return "", nil, nil
+}
+
+// hidesLower reports whether a parent of path in the layer hides the parents
+// in the layers below it
+func hidesLower(dir, path string) bool {
+	for p := filepath.Dir(path); p != "/"; p = filepath.Dir(p) {
+		fi, err := os.Lstat(filepath.Join(dir, p))
+		if err != nil {
+			continue
+		}
+		if !fi.IsDir() || isOpaque(filepath.Join(dir, p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// layerNames lists a directory the way overlayfs merges it from the layers,
+// the top layer first. Nothing is read outside the layers.
+func layerNames(dirs []string, path string) ([]string, error) {
+	path = filepath.Clean("/" + path)
+	var names []string
+	seen := map[string]struct{}{}
+	for _, dir := range dirs {
+		p, err := securejoin.SecureJoin(dir, path)
+		if err != nil {
+			return nil, err
+		}
+		fi, err := os.Lstat(p)
+		if err != nil && !os.IsNotExist(err) && !errors.Is(err, unix.ENOTDIR) {
+			return nil, err
+		}
+		if fi != nil && !fi.IsDir() {
+			break
+		}
+		if fi != nil {
+			entries, err := os.ReadDir(p)
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range entries {
+				if _, ok := seen[entry.Name()]; ok {
+					continue
+				}
+				seen[entry.Name()] = struct{}{}
+				_, efi, err := lookupLayers(dirs, filepath.Join(path, entry.Name()))
+				if err != nil {
+					return nil, err
+				}
+				if efi != nil {
+					names = append(names, entry.Name())
+				}
+			}
+			if isOpaque(p) {
+				break
+			}
+		}
+		if hidesLower(dir, path) {
+			break
+		}
+	}
+	return names, nil
+}
+
+// layerRoot is the content-addressed cache of unpacked layers
+var layerRoot = filepath.Join(stateRoot, "layers")
+
+// layerDir returns the unpacked layer with the given diff id
+func layerDir(diffID string) (string, error) {
+	algo, encoded, err := splitDigest(diffID)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(layerRoot, algo, encoded), nil
+}
+
+func splitDigest(digest string) (string, string, error) {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 || parts[0] != "sha256" || len(parts[1]) != 64 || strings.Trim(parts[1], "0123456789abcdef") != "" {
+		return "", "", fmt.Errorf("invalid digest %q", digest)
+	}
+	return parts[0], parts[1], nil
+}
+
+// hasLayer reports whether the layer is already unpacked in the cache
+func hasLayer(diffID string) bool {
+	dir, err := layerDir(diffID)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(dir)
+	return err == nil
+}
+
+// unpackLayer unpacks a possibly compressed layer tarball into the layer
+// cache and returns its diff id, the digest of the uncompressed tarball. If
+// diffID is not empty the content must match it.
+func unpackLayer(r io.Reader, diffID string) (string, error) {
+	if diffID != "" && hasLayer(diffID) {
+		return diffID, nil
+	}
+	tr, err := decompress(r)
+	if err != nil {
+		return "", err
+	}
+	defer tr.Close()
+
+	if err := os.MkdirAll(layerRoot, 0700); err != nil {
+		return "", err
+	}
+	tmp, err := os.MkdirTemp(layerRoot, "tmp-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return "", err
+	}
+
+	digester := sha256.New()
+	if err := extractLayer(io.TeeReader(tr, digester), tmp, whiteoutOverlay, nil); err != nil {
+		return "", err
+	}
+	// drain the tar padding so the digest covers the whole stream
+	if _, err := io.Copy(digester, tr); err != nil {
+		return "", err
+	}
+	digest := "sha256:" + hex.EncodeToString(digester.Sum(nil))
+	if diffID != "" && digest != diffID {
+		return "", fmt.Errorf("layer content %s does not match diff id %s", digest, diffID)
+	}
+
+	dir, err := layerDir(digest)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(dir), 0700); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, dir); err != nil && !hasLayer(digest) {
+		return "", err
+	}
+	return digest, nil
+}
+
+// decompress detects gzip and bzip2 compressed layers
+func decompress(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		return io.NopCloser(bzip2.NewReader(br)), nil
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return nil, fmt.Errorf("zstd compressed layers are not supported")
+	}
+	return io.NopCloser(br), nil
+}
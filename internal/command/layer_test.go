@@ -0,0 +1,196 @@
+package command
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func layerTar(t *testing.T, names ...string) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range names {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0600}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestExtractLayerWhiteouts(t *testing.T) {
+	tests := []struct {
+		name    string
+		entry   string
+		wantErr bool
+		// removed is deleted by the entry, every other file is kept
+		removed string
+	}{
+		{name: "file", entry: "dir/.wh.file", removed: "dir/file"},
+		{name: "dir", entry: ".wh.dir", removed: "dir"},
+		{name: "opaque dir", entry: "dir/.wh..wh..opq", removed: "dir/file"},
+		{name: "empty name", entry: "dir/.wh.", wantErr: true},
+		{name: "dot", entry: "dir/.wh..", wantErr: true},
+		{name: "dot dot", entry: "dir/.wh...", wantErr: true},
+		{name: "dot at root", entry: ".wh..", wantErr: true},
+		{name: "dot dot at root", entry: ".wh...", wantErr: true},
+		{name: "nested whiteout", entry: "dir/.wh..wh.file", wantErr: true},
+		{name: "opaque root", entry: ".wh..wh..opq", wantErr: true},
+		{name: "opaque root with dot", entry: "./.wh..wh..opq", wantErr: true},
+		{name: "escaping dir", entry: "../../.wh.dir", removed: "dir"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := t.TempDir()
+			root := filepath.Join(base, "root")
+			for _, path := range []string{"root/dir/file", "root/other", "outside"} {
+				path = filepath.Join(base, path)
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := extractLayer(layerTar(t, tt.entry), root, whiteoutRemove, nil)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("extractLayer(%q) error = %v, want error %v", tt.entry, err, tt.wantErr)
+			}
+
+			for _, path := range []string{"root", "root/dir", "root/dir/file", "root/other", "outside"} {
+				_, err := os.Lstat(filepath.Join(base, path))
+				removed := tt.removed != "" && underAny(path, []string{filepath.Join("root", tt.removed)})
+				if removed && !os.IsNotExist(err) {
+					t.Errorf("%s: want removed, got %v", path, err)
+				}
+				if !removed && err != nil {
+					t.Errorf("%s: want kept, got %v", path, err)
+				}
+			}
+		})
+	}
+}
+
+func TestWhiteoutName(t *testing.T) {
+	tests := []struct {
+		base    string
+		want    string
+		wantErr bool
+	}{
+		{base: ".wh.file", want: "file"},
+		{base: ".wh..hidden", want: ".hidden"},
+		{base: ".wh...dots", want: "..dots"},
+		{base: ".wh.", wantErr: true},
+		{base: ".wh..", wantErr: true},
+		{base: ".wh...", wantErr: true},
+		{base: ".wh.a/b", wantErr: true},
+		{base: ".wh..wh..opq", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := whiteoutName(tt.base)
+		if tt.wantErr != (err != nil) || got != tt.want {
+			t.Errorf("whiteoutName(%q) = %q, %v, want %q, error %v", tt.base, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestLookupLayers(t *testing.T) {
+	base := t.TempDir()
+	top, middle, bottom := filepath.Join(base, "top"), filepath.Join(base, "middle"), filepath.Join(base, "bottom")
+	files := map[string]string{
+		"bottom/etc/passwd":  "bottom",
+		"bottom/etc/group":   "bottom",
+		"bottom/opt/app/bin": "bottom",
+		"middle/etc/passwd":  "middle",
+		// a file replacing a directory hides the directory below
+		"middle/opt/app": "middle",
+	}
+	for path, content := range files {
+		path = filepath.Join(base, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dirs := []string{top, middle, bottom}
+
+	// a whiteout deletes the file below, creating one needs CAP_MKNOD
+	wantGroup := bottom
+	if err := os.MkdirAll(filepath.Join(top, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Mknod(filepath.Join(top, "etc/group"), unix.S_IFCHR, 0); err == nil {
+		wantGroup = ""
+	}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "/etc/passwd", want: middle},
+		{path: "/etc/group", want: wantGroup},
+		{path: "/etc/shadow", want: ""},
+		{path: "/opt/app", want: middle},
+		{path: "/opt/app/bin", want: ""},
+	}
+	for _, tt := range tests {
+		got, fi, err := lookupLayers(dirs, tt.path)
+		if err != nil {
+			t.Fatalf("lookupLayers(%q): %v", tt.path, err)
+		}
+		if got != tt.want || (fi == nil) != (tt.want == "") {
+			t.Errorf("lookupLayers(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestLayerNames(t *testing.T) {
+	base := t.TempDir()
+	top, bottom := filepath.Join(base, "top"), filepath.Join(base, "bottom")
+	for _, path := range []string{
+		"bottom/etc/skel/.profile",
+		"bottom/etc/skel/.bashrc",
+		"bottom/etc/other/file",
+		"top/etc/skel/.vimrc",
+		// a file replacing a directory hides the directory below
+		"top/etc/other",
+	} {
+		path = filepath.Join(base, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dirs := []string{top, bottom}
+
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{path: "/etc/skel", want: []string{".vimrc", ".bashrc", ".profile"}},
+		{path: "/etc/other", want: nil},
+		{path: "/missing", want: nil},
+	}
+	for _, tt := range tests {
+		got, err := layerNames(dirs, tt.path)
+		if err != nil {
+			t.Fatalf("layerNames(%q): %v", tt.path, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("layerNames(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package command
+
+import "path/filepath"
+
+const defaultLoginShell = "/bin/sh"
+
+// loginWrapper starts the shell given as $1 with the dash prefixed argv[0]
+// in $0, as login does. A wrapper without exec -a starts it with -l instead.
+const loginWrapper = `shell=$1; shift; if (exec -a sh true) 2>/dev/null; then exec -a "$0" "$shell" "$@"; fi; exec "$shell" -l "$@"`
+
+// loginArgs runs the shell of the user as a login shell, with the command if
+// one is given. The runtime execs args[0] as is, so a wrapper re-execs the
+// shell with its login argv[0]. Shells known to have exec -a wrap themselves,
+// the others are wrapped by /bin/sh.
+func loginArgs(shell string, command []string) []string {
+	if shell == "" {
+		shell = defaultLoginShell
+	}
+	wrapper := defaultLoginShell
+	switch filepath.Base(shell) {
+	case "bash", "zsh", "ksh", "mksh", "ash":
+		wrapper = shell
+	}
+	args := []string{wrapper, "-c", loginWrapper, "-" + filepath.Base(shell), shell}
+	if len(command) > 0 {
+		return append(append(args, "-c", `exec "$@"`, filepath.Base(shell)), command...)
+	}
+	return args
+}
@@ -0,0 +1,67 @@
+package command
+
+import (
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoginArgs(t *testing.T) {
+	tests := []struct {
+		shell   string
+		command []string
+		want    []string
+	}{
+		{
+			shell: "/bin/bash",
+			want:  []string{"/bin/bash", "-c", loginWrapper, "-bash", "/bin/bash"},
+		},
+		{
+			shell:   "/bin/bash",
+			command: []string{"make", "release"},
+			want:    []string{"/bin/bash", "-c", loginWrapper, "-bash", "/bin/bash", "-c", `exec "$@"`, "bash", "make", "release"},
+		},
+		{
+			shell: "/usr/bin/zsh",
+			want:  []string{"/usr/bin/zsh", "-c", loginWrapper, "-zsh", "/usr/bin/zsh"},
+		},
+		{
+			shell: "/usr/bin/fish",
+			want:  []string{"/bin/sh", "-c", loginWrapper, "-fish", "/usr/bin/fish"},
+		},
+		{
+			shell: "/bin/dash",
+			want:  []string{"/bin/sh", "-c", loginWrapper, "-dash", "/bin/dash"},
+		},
+		{
+			shell:   "",
+			command: []string{"id"},
+			want:    []string{"/bin/sh", "-c", loginWrapper, "-sh", "/bin/sh", "-c", `exec "$@"`, "sh", "id"},
+		},
+	}
+	for _, tt := range tests {
+		if got := loginArgs(tt.shell, tt.command); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("loginArgs(%q, %q) = %q, want %q", tt.shell, tt.command, got, tt.want)
+		}
+	}
+}
+
+func TestLoginArgsArgv0(t *testing.T) {
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("bash not found")
+	}
+	args := loginArgs(bash, nil)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), "HOME="+t.TempDir())
+	cmd.Stdin = strings.NewReader(`echo "$0"; shopt -q login_shell && echo login`)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Fields(string(out)); !reflect.DeepEqual(got, []string{"-bash", "login"}) {
+		t.Errorf("login shell printed %q, want -bash and login", got)
+	}
+}
@@ -0,0 +1,153 @@
+package command
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// mountOptions are the options accepted for user-defined mounts
+var mountOptions = map[string]struct{}{
+	"ro": {}, "rw": {},
+	"bind": {}, "rbind": {},
+	"nosuid": {}, "suid": {},
+	"nodev": {}, "dev": {},
+	"noexec": {}, "exec": {},
+	"noatime": {}, "relatime": {}, "strictatime": {},
+	"private": {}, "rprivate": {},
+	"shared": {}, "rshared": {},
+	"slave": {}, "rslave": {},
+}
+
+var propagationOptions = map[string]struct{}{
+	"private": {}, "rprivate": {},
+	"shared": {}, "rshared": {},
+	"slave": {}, "rslave": {},
+}
+
+// parseVolume parses a -v value of the form src:dst[:opt,...]
+func parseVolume(val string) (specs.Mount, error) {
+	parts := strings.SplitN(val, ":", 3)
+	if len(parts) < 2 {
+		return specs.Mount{}, fmt.Errorf("invalid volume %q, expected src:dst[:ro|rw]", val)
+	}
+	m := specs.Mount{
+		Type:        "bind",
+		Source:      parts[0],
+		Destination: parts[1],
+	}
+	if len(parts) == 3 {
+		m.Options = strings.Split(parts[2], ",")
+	}
+	return m, nil
+}
+
+const (
+	propagationPrivate = "private"
+	propagationSlave   = "slave"
+	propagationShared  = "shared"
+)
+
+// propagationOption returns the recursive mount option of a propagation mode
+func propagationOption(propagation string) string {
+	return "r" + propagation
+}
+
+// nsPropagation returns the propagation of the sandbox mount namespace. It
+// is a slave of the host so nothing leaks back, except with shared mounts,
+// which need the host peer groups, where only / itself is made private.
+func nsPropagation(c specConfig) string {
+	if c.AllowSharedMounts {
+		return propagationPrivate
+	}
+	return propagationOption(propagationSlave)
+}
+
+// validatePropagation checks the root and per-mount propagation. Shared
+// mounts let mounts made in the sandbox appear on the host, so they need
+// allowSharedMounts.
+func validatePropagation(c *specConfig) error {
+	switch c.RootPropagation {
+	case "":
+		c.RootPropagation = propagationPrivate
+	case propagationPrivate, propagationSlave:
+	case propagationShared:
+		return fmt.Errorf("rootPropagation shared is not supported, the sandbox root cannot be a shared mount; share single mounts with allowSharedMounts")
+	default:
+		return fmt.Errorf("invalid rootPropagation %q, expected private or slave", c.RootPropagation)
+	}
+	for _, m := range c.Mounts {
+		for _, opt := range m.Options {
+			if (opt == "shared" || opt == "rshared") && !c.AllowSharedMounts {
+				return fmt.Errorf("mount %s: %s propagates sandbox mounts to the host, set allowSharedMounts to allow it", m.Destination, opt)
+			}
+		}
+	}
+	return nil
+}
+
+// validateMount checks a user-defined mount and fills in the defaults. Mounts
+// without a propagation option get the root propagation.
+func validateMount(m specs.Mount, propagation string) (specs.Mount, error) {
+	if !filepath.IsAbs(m.Destination) {
+		return m, fmt.Errorf("mount destination %q is not absolute", m.Destination)
+	}
+	// symlinks are resolved inside the sandbox root by libcontainer
+	dst := filepath.Clean(m.Destination)
+	if dst == "/" {
+		return m, fmt.Errorf("mount destination %q would replace the sandbox root", m.Destination)
+	}
+	m.Destination = dst
+
+	var hasBind, hasPropagation bool
+	for _, opt := range m.Options {
+		if _, ok := mountOptions[opt]; !ok && !(m.Type == "tmpfs" && isTmpfsOption(opt)) {
+			return m, fmt.Errorf("mount %s: unsupported option %q", m.Destination, opt)
+		}
+		if opt == "bind" || opt == "rbind" {
+			hasBind = true
+		}
+		if _, ok := propagationOptions[opt]; ok {
+			hasPropagation = true
+		}
+	}
+	if !hasPropagation {
+		m.Options = append(m.Options, propagationOption(propagation))
+	}
+
+	switch m.Type {
+	case "", "bind":
+		if !filepath.IsAbs(m.Source) {
+			return m, fmt.Errorf("mount source %q is not absolute", m.Source)
+		}
+		if _, err := os.Stat(m.Source); err != nil {
+			return m, fmt.Errorf("mount source %q: %w", m.Source, err)
+		}
+		m.Type = "bind"
+		if !hasBind {
+			m.Options = append([]string{"rbind"}, m.Options...)
+		}
+	case "tmpfs":
+		if m.Source == "" {
+			m.Source = "tmpfs"
+		}
+		if hasBind {
+			return m, fmt.Errorf("mount %s: bind options are not valid for tmpfs", m.Destination)
+		}
+	default:
+		return m, fmt.Errorf("mount %s: unsupported type %q", m.Destination, m.Type)
+	}
+	return m, nil
+}
+
+func isTmpfsOption(opt string) bool {
+	for _, prefix := range []string{"size=", "mode=", "uid=", "gid=", "nr_inodes="} {
+		if strings.HasPrefix(opt, prefix) {
+			return true
+		}
+	}
+	return false
+}
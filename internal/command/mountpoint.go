@@ -0,0 +1,159 @@
+package command
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+)
+
+// mountpoint is a directory created in a host directory for a mount of the
+// sandbox, so it is removed again when the sandbox exits
+type mountpoint struct {
+	Path string `json:"path"`
+	// Created is the topmost directory created, empty if Path existed
+	Created string `json:"created"`
+}
+
+func mountpointsFile(stateDir string) string {
+	return filepath.Join(stateDir, "mountpoints.json")
+}
+
+// prepareMountpoint creates a missing mountpoint before the sandbox starts.
+// runc would otherwise create it in a host directory and leave it behind, or
+// fail to in a read-only root.
+func prepareMountpoint(stateDir string, c specConfig, lowerDirs []string, dir string) error {
+	source := "/"
+	switch {
+	case len(c.Rootfs.Include) > 0:
+		// only an included host path is not private to the sandbox
+		if !underAny(dir, c.Rootfs.Include) {
+			return nil
+		}
+	case c.Rootfs.Mode == rootfsModeOverlay:
+		return mkdirUpper(stateDir, rootLayers(c, lowerDirs), dir)
+	case c.Rootfs.Path != "":
+		source = c.Rootfs.Path
+	}
+	path, err := securejoin.SecureJoin(source, dir)
+	if err != nil {
+		return err
+	}
+	m := mountpoint{Path: path}
+	for p := path; ; p = filepath.Dir(p) {
+		if _, err := os.Lstat(p); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		m.Created = p
+	}
+	if m.Created != "" {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return err
+		}
+	}
+	var mountpoints []mountpoint
+	if err := readJSONFile(mountpointsFile(stateDir), &mountpoints); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	data, err := json.Marshal(append(mountpoints, m))
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(mountpointsFile(stateDir), data, 0600)
+}
+
+// mkdirUpper creates a directory missing from the lower layers in the
+// writable layer. Its parents get the owner and mode they have below.
+func mkdirUpper(stateDir string, roots []string, dir string) error {
+	upper := upperDir(stateDir)
+	var paths []string
+	for p := filepath.Clean(dir); p != "/"; p = filepath.Dir(p) {
+		paths = append([]string{p}, paths...)
+	}
+	for _, p := range paths {
+		_, fi, err := lookupLayers(roots, p)
+		if err != nil {
+			return err
+		}
+		if fi != nil && !fi.IsDir() {
+			// a symlink is left to runc to follow
+			return nil
+		}
+		path := filepath.Join(upper, p)
+		if fi == nil {
+			return os.MkdirAll(path, 0755)
+		}
+		if p == dir {
+			return nil
+		}
+		if _, err := os.Lstat(path); err == nil {
+			continue
+		}
+		if err := os.Mkdir(path, fi.Mode().Perm()); err != nil {
+			return err
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			if err := os.Chown(path, int(st.Uid), int(st.Gid)); err != nil {
+				return err
+			}
+		}
+		if err := os.Chmod(path, fi.Mode().Perm()|fi.Mode()&os.ModeSticky); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseMountpoints returns the mountpoints the sandbox created in host
+// directories, to be removed once the sandbox is destroyed. A mountpoint is
+// kept while another running sandbox uses it.
+func releaseMountpoints(stateDir string) ([]mountpoint, error) {
+	var mountpoints []mountpoint
+	if err := readJSONFile(mountpointsFile(stateDir), &mountpoints); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	entries, err := os.ReadDir(containerStateRoot)
+	if err != nil {
+		return nil, err
+	}
+	used := map[string]struct{}{}
+	for _, entry := range entries {
+		other := filepath.Join(containerStateRoot, entry.Name())
+		var others []mountpoint
+		if other == stateDir || readJSONFile(mountpointsFile(other), &others) != nil {
+			continue
+		}
+		if s, err := loadSandbox(entry.Name()); err != nil || !s.running() {
+			continue
+		}
+		for _, m := range others {
+			used[m.Path] = struct{}{}
+		}
+	}
+	var released []mountpoint
+	for _, m := range mountpoints {
+		if _, ok := used[m.Path]; m.Created != "" && !ok {
+			released = append(released, m)
+		}
+	}
+	return released, nil
+}
+
+// removeMountpoints deletes the created directories, as long as they are empty
+func removeMountpoints(mountpoints []mountpoint) {
+	for _, m := range mountpoints {
+		for p := m.Path; underAny(p, []string{m.Created}); p = filepath.Dir(p) {
+			if os.Remove(p) != nil {
+				break
+			}
+		}
+	}
+}
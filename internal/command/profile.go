@@ -0,0 +1,40 @@
+package command
+
+import "fmt"
+
+const (
+	profileDefault  = "default"
+	profileHardened = "hardened"
+)
+
+// profile holds the defaults used for the options left unset in the config
+type profile struct {
+	noNewPrivileges bool
+	nosuidRoot      bool
+}
+
+var profiles = map[string]profile{
+	profileDefault: {},
+	profileHardened: {
+		noNewPrivileges: true,
+		nosuidRoot:      true,
+	},
+}
+
+// applyProfile fills the unset options with the defaults of the selected profile
+func (c *specConfig) applyProfile() error {
+	if c.Profile == "" {
+		c.Profile = profileDefault
+	}
+	p, ok := profiles[c.Profile]
+	if !ok {
+		return fmt.Errorf("unknown profile %q", c.Profile)
+	}
+	if c.NoNewPrivileges == nil {
+		c.NoNewPrivileges = &p.noNewPrivileges
+	}
+	if c.NosuidRoot == nil {
+		c.NosuidRoot = &p.nosuidRoot
+	}
+	return nil
+}
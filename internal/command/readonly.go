@@ -0,0 +1,155 @@
+package command
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/moby/sys/mountinfo"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// pseudoFilesystems are provided by the sandbox itself and stay as configured
+var pseudoFilesystems = []string{"/proc", "/sys", "/dev"}
+
+// validateWritablePaths checks the paths left writable in a read-only root
+func validateWritablePaths(c *specConfig) error {
+	for _, path := range c.WritablePaths {
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("writable path %q is not absolute", path)
+		}
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("writable path: %w", err)
+		}
+	}
+	for _, path := range c.WritableTmpfs {
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("writable tmpfs %q is not absolute", path)
+		}
+	}
+	return nil
+}
+
+// writableMounts returns the rw bind mounts and tmpfs of a read-only root
+func writableMounts(c specConfig) []specs.Mount {
+	var mounts []specs.Mount
+	for _, path := range c.WritablePaths {
+		mounts = append(mounts, specs.Mount{
+			Destination: filepath.Clean(path),
+			Type:        "bind",
+			Source:      path,
+			Options:     []string{"rbind", "rw", propagationOption(c.RootPropagation)},
+		})
+	}
+	for _, path := range c.WritableTmpfs {
+		mounts = append(mounts, specs.Mount{
+			Destination: filepath.Clean(path),
+			Type:        "tmpfs",
+			Source:      "tmpfs",
+			Options:     []string{"nosuid", "nodev", "mode=1777"},
+		})
+	}
+	return mounts
+}
+
+// rootSubmounts lists the host mounts below the sandbox root that the rbind
+// of the root brings along. Remounting the root does not reach them.
+func rootSubmounts(c specConfig) ([]string, error) {
+	if !c.Rootfs.hostRoot() && len(c.Rootfs.Include) == 0 {
+		return nil, nil
+	}
+	mounts, err := mountinfo.GetMounts(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, m := range mounts {
+		if m.Mountpoint == "/" || m.FSType == "autofs" {
+			continue
+		}
+		if underAny(m.Mountpoint, pseudoFilesystems) || underAny(m.Mountpoint, c.UnmountPaths) {
+			continue
+		}
+		if !c.SharedTmp && underAny(m.Mountpoint, []string{"/tmp"}) {
+			continue
+		}
+		if len(c.Rootfs.Include) > 0 && !underAny(m.Mountpoint, c.Rootfs.Include) {
+			continue
+		}
+		paths = append(paths, m.Mountpoint)
+	}
+	paths = RemoveDuplicateElement(paths)
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// readonlySubmounts lists the submounts of the root that are made read-only
+// one by one, all but those below a writable path.
+func readonlySubmounts(c specConfig) ([]string, error) {
+	submounts, err := rootSubmounts(c)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, path := range submounts {
+		if underAny(path, c.WritablePaths) || underAny(path, c.WritableTmpfs) {
+			continue
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// keptMountFlags maps the statfs flags a nosuid remount keeps to their mount flags
+var keptMountFlags = map[int64]uintptr{
+	unix.ST_RDONLY:      unix.MS_RDONLY,
+	unix.ST_NOEXEC:      unix.MS_NOEXEC,
+	unix.ST_NOATIME:     unix.MS_NOATIME,
+	unix.ST_NODIRATIME:  unix.MS_NODIRATIME,
+	unix.ST_RELATIME:    unix.MS_RELATIME,
+}
+
+// remountNosuidSubmounts runs in the sandbox init, before the root is set up.
+// It remounts the submounts of the root nosuid,nodev in the sandbox mount
+// namespace, so the rbind of the root copies them with these flags. The
+// other flags of each mount are kept.
+func remountNosuidSubmounts(c specConfig) error {
+	if c.NosuidRoot == nil || !*c.NosuidRoot {
+		return nil
+	}
+	submounts, err := rootSubmounts(c)
+	if err != nil {
+		return err
+	}
+	for _, path := range submounts {
+		var st unix.Statfs_t
+		if err := unix.Statfs(path, &st); err != nil {
+			return fmt.Errorf("statfs %s: %w", path, err)
+		}
+		flags := uintptr(unix.MS_NOSUID | unix.MS_NODEV)
+		for stFlag, msFlag := range keptMountFlags {
+			if st.Flags&stFlag != 0 {
+				flags |= msFlag
+			}
+		}
+		if err := unix.Mount("", path, "", unix.MS_REMOUNT|unix.MS_BIND|flags, ""); err != nil {
+			return fmt.Errorf("remount %s nosuid,nodev: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// underAny reports whether path is one of dirs or below one of them
+func underAny(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		dir = filepath.Clean(dir)
+		if path == dir || strings.HasPrefix(path, dir+"/") || dir == "/" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+package command
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/runc/libcontainer/configs"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+const rlimitInfinity = ^uint64(0)
+
+var rlimitMap = map[string]int{
+	"RLIMIT_CPU":        unix.RLIMIT_CPU,
+	"RLIMIT_FSIZE":      unix.RLIMIT_FSIZE,
+	"RLIMIT_DATA":       unix.RLIMIT_DATA,
+	"RLIMIT_STACK":      unix.RLIMIT_STACK,
+	"RLIMIT_CORE":       unix.RLIMIT_CORE,
+	"RLIMIT_RSS":        unix.RLIMIT_RSS,
+	"RLIMIT_NPROC":      unix.RLIMIT_NPROC,
+	"RLIMIT_NOFILE":     unix.RLIMIT_NOFILE,
+	"RLIMIT_MEMLOCK":    unix.RLIMIT_MEMLOCK,
+	"RLIMIT_AS":         unix.RLIMIT_AS,
+	"RLIMIT_LOCKS":      unix.RLIMIT_LOCKS,
+	"RLIMIT_SIGPENDING": unix.RLIMIT_SIGPENDING,
+	"RLIMIT_MSGQUEUE":   unix.RLIMIT_MSGQUEUE,
+	"RLIMIT_NICE":       unix.RLIMIT_NICE,
+	"RLIMIT_RTPRIO":     unix.RLIMIT_RTPRIO,
+	"RLIMIT_RTTIME":     unix.RLIMIT_RTTIME,
+}
+
+// defaultRlimits are applied unless the config or --ulimit overrides them
+var defaultRlimits = []specs.POSIXRlimit{
+	{
+		Type: "RLIMIT_NOFILE",
+		Hard: uint64(1024),
+		Soft: uint64(1024),
+	},
+}
+
+// normalizeRlimitType accepts both "nofile" and "RLIMIT_NOFILE" and returns the latter
+func normalizeRlimitType(name string) (string, error) {
+	key := strings.ToUpper(name)
+	if !strings.HasPrefix(key, "RLIMIT_") {
+		key = "RLIMIT_" + key
+	}
+	if _, ok := rlimitMap[key]; !ok {
+		return "", fmt.Errorf("unknown rlimit %q", name)
+	}
+	return key, nil
+}
+
+func createLibContainerRlimit(rlimit specs.POSIXRlimit) (configs.Rlimit, error) {
+	rl, ok := rlimitMap[rlimit.Type]
+	if !ok {
+		return configs.Rlimit{}, fmt.Errorf("unknown rlimit %q", rlimit.Type)
+	}
+	return configs.Rlimit{
+		Type: rl,
+		Hard: rlimit.Hard,
+		Soft: rlimit.Soft,
+	}, nil
+}
+
+// parseUlimit parses a --ulimit value of the form name=soft[:hard]
+func parseUlimit(val string) (specs.POSIXRlimit, error) {
+	parts := strings.SplitN(val, "=", 2)
+	if len(parts) != 2 {
+		return specs.POSIXRlimit{}, fmt.Errorf("invalid ulimit %q, expected name=soft[:hard]", val)
+	}
+	typ, err := normalizeRlimitType(parts[0])
+	if err != nil {
+		return specs.POSIXRlimit{}, err
+	}
+	limits := strings.SplitN(parts[1], ":", 2)
+	soft, err := parseRlimitValue(limits[0])
+	if err != nil {
+		return specs.POSIXRlimit{}, fmt.Errorf("invalid ulimit %q: %v", val, err)
+	}
+	hard := soft
+	if len(limits) == 2 {
+		if hard, err = parseRlimitValue(limits[1]); err != nil {
+			return specs.POSIXRlimit{}, fmt.Errorf("invalid ulimit %q: %v", val, err)
+		}
+	}
+	return specs.POSIXRlimit{Type: typ, Soft: soft, Hard: hard}, nil
+}
+
+func parseRlimitValue(val string) (uint64, error) {
+	if val == "unlimited" || val == "-1" {
+		return rlimitInfinity, nil
+	}
+	return strconv.ParseUint(val, 10, 64)
+}
+
+// mergeRlimits overrides the rlimits in base by type, in order of the given overrides
+func mergeRlimits(base []specs.POSIXRlimit, overrides ...[]specs.POSIXRlimit) ([]specs.POSIXRlimit, error) {
+	result := append([]specs.POSIXRlimit{}, base...)
+	index := make(map[string]int, len(result))
+	for i, rl := range result {
+		index[rl.Type] = i
+	}
+	for _, override := range overrides {
+		for _, rl := range override {
+			typ, err := normalizeRlimitType(rl.Type)
+			if err != nil {
+				return nil, err
+			}
+			rl.Type = typ
+			if rl.Soft > rl.Hard {
+				return nil, fmt.Errorf("rlimit %s: soft limit %d is greater than hard limit %d", typ, rl.Soft, rl.Hard)
+			}
+			if i, ok := index[typ]; ok {
+				result[i] = rl
+				continue
+			}
+			index[typ] = len(result)
+			result = append(result, rl)
+		}
+	}
+	return result, nil
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/opencontainers/runtime-spec/specs-go"
 	"os"
+	"path/filepath"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -12,16 +13,85 @@ import (
 
 //execOptions
 type execOptions struct {
-	user       string
-	config     string
-	command    []string
-	specConfig specConfig
+	user            string
+	config          string
+	profile         string
+	noNewPrivileges bool
+	nosuidRoot      bool
+	ulimits         []string
+	strict          bool
+	volumes         []string
+	rootfsMode      string
+	rootfsPath      string
+	image           string
+	include         []string
+	readonlyRoot    bool
+	writablePaths   []string
+	writableTmpfs   []string
+	tmpSize         string
+	workdir         string
+	keepCwd         bool
+	devices         []string
+	shmSize         string
+	home            string
+	storageSize     string
+	addHosts        []string
+	dns             []string
+	dnsSearch       []string
+	secrets         []string
+	sockets         []string
+	groupAdd        []string
+	env             []string
+	envFiles        []string
+	login           bool
+	userChanged     bool
+	// the hardened profile defaults can be turned off with =false
+	noNewPrivilegesChanged bool
+	nosuidRootChanged      bool
+	resolvedImage          *image
+	// homeDir is the home directory of the resolved user
+	homeDir                string
+	command                []string
+	specConfig             specConfig
 }
 
 type specConfig struct {
-	Ropath       []string                `json:"readonlyPaths"`
-	Capabilities specs.LinuxCapabilities `json:"capabilities"`
-	UnmountPaths []string                `json:"unmountPaths"`
+	Ropath             []string                      `json:"readonlyPaths"`
+	Capabilities       specs.LinuxCapabilities       `json:"capabilities"`
+	UnmountPaths       []string                      `json:"unmountPaths"`
+	Profile            string                        `json:"profile"`
+	NoNewPrivileges    *bool                         `json:"noNewPrivileges"`
+	NosuidRoot         *bool                         `json:"nosuidRoot"`
+	Rlimits            []specs.POSIXRlimit           `json:"rlimits"`
+	MaskedPaths        []string                      `json:"maskedPaths"`
+	ReplaceMaskedPaths bool                          `json:"replaceMaskedPaths"`
+	HiddenPaths        []string                      `json:"hiddenPaths"`
+	Strict             bool                          `json:"strict"`
+	Mounts             []specs.Mount                 `json:"mounts"`
+	Rootfs             rootfsConfig                  `json:"rootfs"`
+	ReadonlyRoot       bool                          `json:"readonlyRoot"`
+	WritablePaths      []string                      `json:"writablePaths"`
+	WritableTmpfs      []string                      `json:"writableTmpfs"`
+	TmpSize            string                        `json:"tmpSize"`
+	SharedTmp          bool                          `json:"sharedTmp"`
+	Workdir            string                        `json:"workdir"`
+	KeepCwd            bool                          `json:"keepCwd"`
+	Devices            []deviceConfig                `json:"devices"`
+	ShmSize            string                        `json:"shmSize"`
+	BuiltinMounts      map[string]builtinMountConfig `json:"builtinMounts"`
+	Home               string                        `json:"home"`
+	StorageSize        string                        `json:"storageSize"`
+	RootPropagation    string                        `json:"rootPropagation"`
+	AllowSharedMounts  bool                          `json:"allowSharedMounts"`
+	AddHosts           []string                      `json:"addHosts"`
+	DNS                []string                      `json:"dns"`
+	DNSSearch          []string                      `json:"dnsSearch"`
+	ExtraUsers         []extraUser                   `json:"extraUsers"`
+	Secrets            []secretConfig                `json:"secrets"`
+	Sockets            []socketConfig                `json:"sockets"`
+	SocketEnv          []string                      `json:"socketEnv"`
+	GroupAdd           []string                      `json:"groupAdd"`
+	Env                envConfig                     `json:"env"`
 }
 
 var rootCmd = newExecCommand()
@@ -36,17 +106,76 @@ func newExecCommand() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "sandbox COMMAND [ARG...]",
 		Short: "Run in a sandbox",
-		Args:  RequiresMinArgs(1),
+		Long:  "Run in a sandbox\n\nSandboxes, images and volumes are managed with \"sandbox ctl\".",
+		// COMMAND is checked once the config is loaded, as an image may
+		// define it and a login shell needs none
+		Args: cobra.ArbitraryArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			options.command = args[0:]
+			options.userChanged = cmd.Flags().Changed("user")
+			options.noNewPrivilegesChanged = cmd.Flags().Changed("no-new-privileges")
+			options.nosuidRootChanged = cmd.Flags().Changed("nosuid-root")
 			return runExec(options)
 		},
 	}
 
+	cmd.CompletionOptions.DisableDefaultCmd = true
+
 	flags := cmd.Flags()
 	flags.SetInterspersed(false)
-	flags.StringVarP(&options.user, "user", "u", "root", "User run in Sandbox")
+	flags.StringVarP(&options.user, "user", "u", "root", "User run in Sandbox, name|uid[:group|gid]")
+	flags.StringArrayVar(&options.groupAdd, "group-add", nil, "Additional group, name or gid")
+	flags.BoolVar(&options.login, "login", false, "Run the user's shell as a login shell in the home directory")
 	flags.StringVarP(&options.config, "config", "c", "./config", "Sandbox config path")
+	flags.StringVar(&options.profile, "profile", "", "Security profile (default|hardened)")
+	flags.BoolVar(&options.noNewPrivileges, "no-new-privileges", false, "Disable privilege escalation through setuid binaries")
+	flags.BoolVar(&options.nosuidRoot, "nosuid-root", false, "Mount the root nosuid,nodev")
+	flags.StringArrayVar(&options.ulimits, "ulimit", nil, "Resource limit name=soft[:hard]")
+	flags.BoolVar(&options.strict, "strict", false, "Abort if a path cannot be unmounted or hidden")
+	flags.StringArrayVarP(&options.volumes, "volume", "v", nil, "Bind mount src:dst[:ro|rw,...], src may name a volume")
+	flags.StringVar(&options.rootfsMode, "rootfs-mode", "", "Root filesystem mode (bind|overlay)")
+	flags.StringVar(&options.rootfsPath, "rootfs", "", "Root filesystem directory used instead of the host root")
+	flags.StringVar(&options.image, "image", "", "Image to run, a local image or oci-layout-dir[:tag]")
+	flags.StringArrayVar(&options.include, "include", nil, "Compose the root from only these host paths")
+	flags.BoolVar(&options.readonlyRoot, "read-only", false, "Mount the root read-only")
+	flags.StringArrayVar(&options.writablePaths, "writable", nil, "Host path left writable in a read-only root")
+	flags.StringArrayVar(&options.writableTmpfs, "tmpfs", nil, "Writable tmpfs mounted in a read-only root")
+	flags.StringVar(&options.tmpSize, "tmp-size", "", "Size of the private /tmp (default "+defaultTmpSize+")")
+	flags.StringVarP(&options.workdir, "workdir", "w", "", "Working directory inside the sandbox")
+	flags.BoolVar(&options.keepCwd, "keep-cwd", false, "Start in the current directory")
+	flags.StringArrayVar(&options.devices, "device", nil, "Host device host[:container][:rwm]")
+	flags.StringVar(&options.shmSize, "shm-size", "", "Size of /dev/shm (default 65536k)")
+	flags.StringVar(&options.home, "home", "", "Home directory mode (host|tmpfs|persistent)")
+	flags.StringVar(&options.storageSize, "storage-size", "", "Size limit of the writable layer of a copy-on-write root")
+	flags.StringArrayVar(&options.addHosts, "add-host", nil, "Add a name:ip entry to /etc/hosts")
+	flags.StringArrayVar(&options.dns, "dns", nil, "DNS server written to /etc/resolv.conf")
+	flags.StringArrayVar(&options.dnsSearch, "dns-search", nil, "DNS search domain written to /etc/resolv.conf")
+	flags.StringArrayVar(&options.secrets, "secret", nil, "Secret src=PATH[,target=PATH][,mode=0400][,uid=N][,gid=N][,hide]")
+	flags.StringArrayVar(&options.sockets, "forward-socket", nil, "Forward a host socket, VARIABLE or path[:target]")
+	flags.StringArrayVarP(&options.env, "env", "e", nil, "Set a variable KEY=VAL, or KEY to pass the host value")
+	flags.StringArrayVar(&options.envFiles, "env-file", nil, "Read variables from a file of KEY=VAL lines")
+	return cmd
+}
+
+// newCtlCommand groups the commands that manage sandboxes, images and
+// volumes under "sandbox ctl". The root command has no subcommands, so a
+// COMMAND like diff or help still runs in a sandbox.
+func newCtlCommand() *cobra.Command {
+	ctl := &cobra.Command{
+		Use:   "ctl",
+		Short: "Manage sandboxes, images and volumes",
+	}
+	ctl.AddCommand(
+		newDiffCommand(),
+		newExportChangesCommand(),
+		newApplyChangesCommand(),
+		newImageCommand(),
+		newCommitCommand(),
+		newVolumeCommand(),
+	)
+	cmd := &cobra.Command{Use: "sandbox"}
+	cmd.CompletionOptions.DisableDefaultCmd = true
+	cmd.AddCommand(ctl)
 	return cmd
 }
 
@@ -62,11 +191,171 @@ func LoadConfig(options *execOptions) error {
 	}
 	defer cf.Close()
 	err = json.NewDecoder(cf).Decode(&options.specConfig)
+	if err != nil {
+		return err
+	}
 	options.specConfig.Ropath = RemoveDuplicateElement(options.specConfig.Ropath)
 	if isDuplicate(options.specConfig.Ropath, options.specConfig.UnmountPaths) {
 		return fmt.Errorf("there is duplication in readonlyPaths and unmountPaths")
 	}
-	return err
+	if options.profile != "" {
+		options.specConfig.Profile = options.profile
+	}
+	if options.noNewPrivilegesChanged {
+		options.specConfig.NoNewPrivileges = &options.noNewPrivileges
+	}
+	if options.nosuidRootChanged {
+		options.specConfig.NosuidRoot = &options.nosuidRoot
+	}
+	if options.strict {
+		options.specConfig.Strict = true
+	}
+	if options.rootfsMode != "" {
+		options.specConfig.Rootfs.Mode = options.rootfsMode
+	}
+	if options.rootfsPath != "" {
+		options.specConfig.Rootfs.Path = options.rootfsPath
+	}
+	if options.image != "" {
+		options.specConfig.Rootfs.Image = options.image
+	}
+	options.specConfig.Rootfs.Include = append(options.specConfig.Rootfs.Include, options.include...)
+	if options.readonlyRoot {
+		options.specConfig.ReadonlyRoot = true
+	}
+	options.specConfig.WritablePaths = append(options.specConfig.WritablePaths, options.writablePaths...)
+	options.specConfig.WritableTmpfs = append(options.specConfig.WritableTmpfs, options.writableTmpfs...)
+	if options.tmpSize != "" {
+		options.specConfig.TmpSize = options.tmpSize
+	}
+	if options.workdir != "" {
+		options.specConfig.Workdir = options.workdir
+	}
+	if options.keepCwd {
+		options.specConfig.KeepCwd = true
+	}
+	if options.shmSize != "" {
+		options.specConfig.ShmSize = options.shmSize
+	}
+	if err = validateBuiltinMounts(&options.specConfig); err != nil {
+		return err
+	}
+	if options.home != "" {
+		options.specConfig.Home = options.home
+	}
+	if err = validateHomeMode(&options.specConfig); err != nil {
+		return err
+	}
+	options.specConfig.AddHosts = append(options.specConfig.AddHosts, options.addHosts...)
+	options.specConfig.DNS = append(options.specConfig.DNS, options.dns...)
+	options.specConfig.DNSSearch = append(options.specConfig.DNSSearch, options.dnsSearch...)
+	if err = validateEtc(&options.specConfig); err != nil {
+		return err
+	}
+	options.specConfig.GroupAdd = append(options.specConfig.GroupAdd, options.groupAdd...)
+	for _, val := range options.secrets {
+		secret, err := parseSecret(val)
+		if err != nil {
+			return err
+		}
+		options.specConfig.Secrets = append(options.specConfig.Secrets, secret)
+	}
+	if err = validateSecrets(&options.specConfig); err != nil {
+		return err
+	}
+	for _, val := range options.sockets {
+		socket, err := parseForwardSocket(val)
+		if err != nil {
+			return err
+		}
+		options.specConfig.Sockets = append(options.specConfig.Sockets, socket)
+	}
+	if err = validateSockets(&options.specConfig); err != nil {
+		return err
+	}
+	for _, path := range options.envFiles {
+		vars, err := readEnvFile(path)
+		if err != nil {
+			return err
+		}
+		options.specConfig.Env.Vars = append(options.specConfig.Env.Vars, vars...)
+	}
+	for _, val := range options.env {
+		kv, ok, err := parseEnv(val)
+		if err != nil {
+			return err
+		}
+		if ok {
+			options.specConfig.Env.Vars = append(options.specConfig.Env.Vars, kv)
+		}
+	}
+	if err = validateEnv(&options.specConfig); err != nil {
+		return err
+	}
+	if err = validateTmp(&options.specConfig); err != nil {
+		return err
+	}
+	if err = validateWritablePaths(&options.specConfig); err != nil {
+		return err
+	}
+	if err = options.specConfig.Rootfs.validate(); err != nil {
+		return err
+	}
+	if options.storageSize != "" {
+		options.specConfig.StorageSize = options.storageSize
+	}
+	if err = validateStorageSize(&options.specConfig); err != nil {
+		return err
+	}
+	for _, path := range options.specConfig.MaskedPaths {
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("masked path %q is not absolute", path)
+		}
+	}
+	for _, val := range options.volumes {
+		m, err := parseVolume(val)
+		if err != nil {
+			return err
+		}
+		options.specConfig.Mounts = append(options.specConfig.Mounts, m)
+	}
+	if err = validatePropagation(&options.specConfig); err != nil {
+		return err
+	}
+	for _, val := range options.devices {
+		d, err := parseDevice(val)
+		if err != nil {
+			return err
+		}
+		options.specConfig.Devices = append(options.specConfig.Devices, d)
+	}
+	if err = validateDevices(&options.specConfig); err != nil {
+		return err
+	}
+	for i, m := range options.specConfig.Mounts {
+		// a source that is not a path names a volume
+		if (m.Type == "" || m.Type == "bind") && m.Source != "" && !filepath.IsAbs(m.Source) {
+			if m.Source, err = volumeSource(m.Source); err != nil {
+				return err
+			}
+		}
+		if options.specConfig.Mounts[i], err = validateMount(m, options.specConfig.RootPropagation); err != nil {
+			return err
+		}
+	}
+	ulimits := make([]specs.POSIXRlimit, 0, len(options.ulimits))
+	for _, val := range options.ulimits {
+		rl, err := parseUlimit(val)
+		if err != nil {
+			return err
+		}
+		ulimits = append(ulimits, rl)
+	}
+	options.specConfig.Rlimits, err = mergeRlimits(defaultRlimits, options.specConfig.Rlimits, ulimits)
+	if err != nil {
+		return err
+	}
+	return options.specConfig.applyProfile()
 }
 
 //Determine if there is duplication in readonlyPaths and unmountPaths
@@ -107,6 +396,20 @@ func runExec(options execOptions) error {
 	if err != nil {
 		return err
 	}
+	var lowerDirs []string
+	if options.specConfig.Rootfs.Image != "" {
+		options.resolvedImage, err = resolveImage(options.specConfig.Rootfs.Image)
+		if err != nil {
+			return err
+		}
+		if lowerDirs, err = options.resolvedImage.lowerDirs(); err != nil {
+			return err
+		}
+	}
+	err = checkHiddenPaths(options.specConfig, lowerDirs, cli.Err())
+	if err != nil {
+		return err
+	}
 	spec, sandboxContainer, err := cli.CreateSandboxContainer(options)
 	if err != nil {
 		return err
@@ -126,7 +429,11 @@ func Execute() {
 		println("ERROR: please run sandbox with root")
 		os.Exit(1)
 	}
-	if err := rootCmd.Execute(); err != nil {
+	cmd := rootCmd
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		cmd = newCtlCommand()
+	}
+	if err := cmd.Execute(); err != nil {
 		logrus.Debugf("%+v", err)
 
 	}
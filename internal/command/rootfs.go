@@ -0,0 +1,210 @@
+package command
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+const (
+	rootfsModeBind    = "bind"
+	rootfsModeOverlay = "overlay"
+)
+
+// rootfsConfig describes how the sandbox root is built
+type rootfsConfig struct {
+	Mode string `json:"mode"`
+	// Path is a root filesystem directory used instead of the host root
+	Path string `json:"path"`
+	// Image is a local image or an OCI image layout, oci-layout-dir[:tag]
+	Image string `json:"image"`
+	// Include composes the root from these host paths on an empty tmpfs
+	Include []string `json:"include"`
+}
+
+func (r *rootfsConfig) validate() error {
+	if r.Path != "" && r.Image != "" {
+		return fmt.Errorf("rootfs path and image are mutually exclusive")
+	}
+	if len(r.Include) > 0 {
+		if r.Path != "" || r.Image != "" {
+			return fmt.Errorf("rootfs include can not be combined with a rootfs path or image")
+		}
+		if r.Mode != "" && r.Mode != rootfsModeBind {
+			return fmt.Errorf("rootfs include can only be used with the %s mode", rootfsModeBind)
+		}
+		for i, path := range r.Include {
+			if !filepath.IsAbs(path) {
+				return fmt.Errorf("rootfs include %q is not absolute", path)
+			}
+			if _, err := os.Stat(path); err != nil {
+				return fmt.Errorf("rootfs include: %w", err)
+			}
+			r.Include[i] = filepath.Clean(path)
+		}
+		r.Include = RemoveDuplicateElement(r.Include)
+		// parents are mounted before the paths below them
+		sort.Strings(r.Include)
+	}
+	if r.Path != "" {
+		fi, err := os.Stat(r.Path)
+		if err != nil {
+			return fmt.Errorf("rootfs path: %w", err)
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("rootfs path %s is not a directory", r.Path)
+		}
+		if r.Path, err = filepath.Abs(r.Path); err != nil {
+			return err
+		}
+	}
+	switch r.Mode {
+	case "":
+		r.Mode = rootfsModeBind
+		// image layers are shared, so they are only ever mounted copy-on-write
+		if r.Image != "" {
+			r.Mode = rootfsModeOverlay
+		}
+	case rootfsModeBind:
+		if r.Image != "" {
+			return fmt.Errorf("rootfs image can only be used with the %s mode", rootfsModeOverlay)
+		}
+	case rootfsModeOverlay:
+	default:
+		return fmt.Errorf("unknown rootfs mode %q, expected %s or %s", r.Mode, rootfsModeBind, rootfsModeOverlay)
+	}
+	return nil
+}
+
+// hostRoot reports whether the sandbox root is the host root
+func (r *rootfsConfig) hostRoot() bool {
+	return r.Path == "" && r.Image == "" && len(r.Include) == 0
+}
+
+// upperDir is the writable layer of an overlay rooted sandbox
+func upperDir(stateDir string) string {
+	return filepath.Join(writableDir(stateDir), "upper")
+}
+
+func workDir(stateDir string) string {
+	return filepath.Join(writableDir(stateDir), "work")
+}
+
+// rootMounts returns the mounts that make up the sandbox root. lowerDirs
+// are the read-only layers of an image, the top layer first.
+func rootMounts(stateDir string, c specConfig, lowerDirs []string) []specs.Mount {
+	access := "rw"
+	if c.ReadonlyRoot {
+		access = "ro"
+	}
+	extra := []string{access}
+	if *c.NosuidRoot {
+		extra = append(extra, "nosuid", "nodev")
+	}
+
+	source := "/"
+	if c.Rootfs.Path != "" {
+		source = c.Rootfs.Path
+	}
+	if len(lowerDirs) == 0 {
+		lowerDirs = []string{source}
+	}
+
+	var mounts []specs.Mount
+	if len(c.Rootfs.Include) > 0 {
+		// everything that is not included is simply absent
+		mounts = append(mounts, specs.Mount{
+			Destination: "/",
+			Type:        "tmpfs",
+			Source:      "tmpfs",
+			Options:     []string{"mode=755", "nosuid", "nodev"},
+		})
+		for _, path := range c.Rootfs.Include {
+			mounts = append(mounts, specs.Mount{
+				Destination: path,
+				Type:        "bind",
+				Source:      path,
+				Options:     append([]string{"rbind", propagationOption(c.RootPropagation)}, extra...),
+			})
+		}
+	} else if c.Rootfs.Mode == rootfsModeOverlay {
+		mounts = append(mounts, specs.Mount{
+			Destination: "/",
+			Type:        "overlay",
+			Source:      "overlay",
+			Options: append([]string{
+				"lowerdir=" + strings.Join(lowerDirs, ":"),
+				"upperdir=" + upperDir(stateDir),
+				"workdir=" + workDir(stateDir),
+			}, extra...),
+		})
+	} else {
+		mounts = append(mounts, specs.Mount{
+			Destination: "/",
+			Type:        "rbind",
+			Source:      source,
+			Options:     append([]string{"rbind", propagationOption(c.RootPropagation)}, extra...),
+		})
+		if c.Rootfs.hostRoot() {
+			return mounts
+		}
+	}
+
+	// overlayfs does not descend into submounts and another root filesystem
+	// has none, so the host /proc and /sys are bound on top of it.
+	return append(mounts, []specs.Mount{
+		{
+			Destination: "/proc",
+			Type:        "bind",
+			Source:      "/proc",
+			Options:     []string{"rbind", "rprivate"},
+		},
+		{
+			Destination: "/sys",
+			Type:        "bind",
+			Source:      "/sys",
+			Options:     []string{"rbind", "rprivate", "nosuid", "noexec", "nodev"},
+		},
+	}...)
+}
+
+// prepareRootfs creates the directories the root mounts need in the container state dir
+func prepareRootfs(stateDir string, c specConfig, lowerDirs []string) error {
+	if c.Rootfs.Mode != rootfsModeOverlay {
+		return nil
+	}
+	if err := prepareLayer(stateDir, c); err != nil {
+		return err
+	}
+	if err := os.Mkdir(workDir(stateDir), 0700); err != nil {
+		return err
+	}
+	// the upper dir is the root directory of the sandbox, it takes the mode
+	// and owner of the lower root so other users can traverse it
+	source := "/"
+	if c.Rootfs.Path != "" {
+		source = c.Rootfs.Path
+	}
+	if len(lowerDirs) > 0 {
+		source = lowerDirs[0]
+	}
+	fi, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	upper := upperDir(stateDir)
+	if err := os.Mkdir(upper, 0700); err != nil {
+		return err
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		if err := os.Chown(upper, int(st.Uid), int(st.Gid)); err != nil {
+			return err
+		}
+	}
+	return os.Chmod(upper, fi.Mode().Perm()|fi.Mode()&os.ModeSticky)
+}
@@ -164,6 +164,13 @@ func newProcess(p specs.Process, init bool, logLevel string) (*libcontainer.Proc
 	for _, gid := range p.User.AdditionalGids {
 		lp.AdditionalGroups = append(lp.AdditionalGroups, strconv.FormatUint(uint64(gid), 10))
 	}
+	for _, rlimit := range p.Rlimits {
+		rl, err := createLibContainerRlimit(rlimit)
+		if err != nil {
+			return nil, err
+		}
+		lp.Rlimits = append(lp.Rlimits, rl)
+	}
 	return lp, nil
 }
 
@@ -219,7 +226,7 @@ func (cli *SandboxCli) run(config *specs.Process, c libcontainer.Container) erro
 	var err error
 	defer func() {
 		if err != nil {
-			c.Destroy()
+			cli.CleanSandboxContainer(c)
 		}
 	}()
 	process, err := newProcess(*config, true, "info")
@@ -272,8 +279,5 @@ func (cli *SandboxCli) run(config *specs.Process, c libcontainer.Container) erro
 		return errors.WithStack(err)
 	}
 	/* c.Destroy will send SIGKILL to all process in container */
-	if err == nil {
-		c.Destroy()
-	}
-	return err
+	return cli.CleanSandboxContainer(c)
 }
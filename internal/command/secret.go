@@ -0,0 +1,226 @@
+package command
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/moby/sys/mountinfo"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	defaultSecretDir  = "/run/secrets"
+	defaultSecretMode = "0400"
+)
+
+// secretConfig is a host file copied into the sandbox at start
+type secretConfig struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+	Mode   string `json:"mode"`
+	// UID and GID default to the sandbox user
+	UID *int `json:"uid"`
+	GID *int `json:"gid"`
+	// Hide hides the source path in the sandbox
+	Hide bool `json:"hide"`
+}
+
+// parseSecret parses a --secret value of the form
+// src=PATH[,target=PATH][,mode=0400][,uid=N][,gid=N][,hide]
+func parseSecret(val string) (secretConfig, error) {
+	var s secretConfig
+	for _, field := range strings.Split(val, ",") {
+		kv := strings.SplitN(field, "=", 2)
+		key, value := kv[0], ""
+		if len(kv) == 2 {
+			value = kv[1]
+		}
+		switch key {
+		case "src", "source":
+			s.Source = value
+		case "target", "dst":
+			s.Target = value
+		case "mode":
+			s.Mode = value
+		case "uid", "gid":
+			id, err := strconv.Atoi(value)
+			if err != nil || id < 0 {
+				return s, fmt.Errorf("invalid secret %q: bad %s %q", val, key, value)
+			}
+			if key == "uid" {
+				s.UID = &id
+			} else {
+				s.GID = &id
+			}
+		case "hide":
+			hide, err := strconv.ParseBool(value)
+			if len(kv) == 1 {
+				hide, err = true, nil
+			}
+			if err != nil {
+				return s, fmt.Errorf("invalid secret %q: bad hide %q", val, value)
+			}
+			s.Hide = hide
+		default:
+			return s, fmt.Errorf("invalid secret %q: unknown key %q", val, key)
+		}
+	}
+	return s, nil
+}
+
+// validateSecrets checks the secret sources and fills in the defaults
+func validateSecrets(c *specConfig) error {
+	targets := map[string]struct{}{}
+	for i := range c.Secrets {
+		s := &c.Secrets[i]
+		if !filepath.IsAbs(s.Source) {
+			return fmt.Errorf("secret source %q is not absolute", s.Source)
+		}
+		fi, err := os.Stat(s.Source)
+		if err != nil {
+			return fmt.Errorf("secret: %w", err)
+		}
+		if !fi.Mode().IsRegular() {
+			return fmt.Errorf("secret %s is not a regular file", s.Source)
+		}
+		if s.Target == "" {
+			s.Target = filepath.Join(defaultSecretDir, filepath.Base(s.Source))
+		}
+		if !filepath.IsAbs(s.Target) {
+			return fmt.Errorf("secret target %q is not absolute", s.Target)
+		}
+		s.Target = filepath.Clean(s.Target)
+		if s.Target == defaultSecretDir || !underAny(s.Target, []string{defaultSecretDir}) {
+			return fmt.Errorf("secret target %s is not below %s", s.Target, defaultSecretDir)
+		}
+		for target := range targets {
+			if underAny(s.Target, []string{target}) || underAny(target, []string{s.Target}) {
+				return fmt.Errorf("secret targets %s and %s overlap", target, s.Target)
+			}
+		}
+		targets[s.Target] = struct{}{}
+		if s.Mode == "" {
+			s.Mode = defaultSecretMode
+		}
+		if mode, err := strconv.ParseUint(s.Mode, 8, 32); err != nil || mode > 0777 {
+			return fmt.Errorf("secret %s: invalid mode %q", s.Source, s.Mode)
+		}
+		// only a root built from the host shows the source
+		if s.Hide && (c.Rootfs.hostRoot() || underAny(s.Source, c.Rootfs.Include)) {
+			c.HiddenPaths = append(c.HiddenPaths, s.Source)
+		}
+	}
+	return nil
+}
+
+// secretsDir is the mountpoint of the tmpfs holding the secrets. The tmpfs
+// is only ever mounted in the sandbox mount namespace.
+func secretsDir(stateDir string) string {
+	return filepath.Join(stateDir, "secrets")
+}
+
+// secretFile is the copy of the secret with the given target
+func secretFile(stateDir string, target string) string {
+	return filepath.Join(secretsDir(stateDir), strings.TrimPrefix(target, defaultSecretDir))
+}
+
+// secretMounts binds the secrets tmpfs read-only on /run/secrets, so the
+// targets below it need no mountpoints of their own
+func secretMounts(stateDir string, c specConfig) []specs.Mount {
+	if len(c.Secrets) == 0 {
+		return nil
+	}
+	return []specs.Mount{{
+		Destination: defaultSecretDir,
+		Type:        "bind",
+		Source:      secretsDir(stateDir),
+		Options:     []string{"bind", "ro", "nosuid", "nodev", "noexec", "rprivate"},
+	}}
+}
+
+// secretOwners makes the sandbox user the default owner of the secrets
+func secretOwners(c *specConfig, uid, gid int) {
+	for i := range c.Secrets {
+		if c.Secrets[i].UID == nil {
+			c.Secrets[i].UID = &uid
+		}
+		if c.Secrets[i].GID == nil {
+			c.Secrets[i].GID = &gid
+		}
+	}
+}
+
+// prepareSecrets creates the mountpoint of the secrets tmpfs, and that of
+// /run/secrets in the root
+func prepareSecrets(stateDir string, c specConfig, lowerDirs []string) error {
+	if len(c.Secrets) == 0 {
+		return nil
+	}
+	if err := os.Mkdir(secretsDir(stateDir), 0700); err != nil {
+		return err
+	}
+	return prepareMountpoint(stateDir, c, lowerDirs, defaultSecretDir)
+}
+
+// setupSecrets runs in the sandbox init, before the root is set up. It
+// mounts the secrets tmpfs in the sandbox mount namespace and copies the
+// secrets onto it, so they vanish with the sandbox.
+func setupSecrets(stateDir string, c specConfig) error {
+	if len(c.Secrets) == 0 {
+		return nil
+	}
+	dir := secretsDir(stateDir)
+	if c.AllowSharedMounts {
+		// keep the tmpfs from propagating to a shared host mount
+		mounts, err := mountinfo.GetMounts(mountinfo.ParentsFilter(dir))
+		if err != nil {
+			return err
+		}
+		sort.Slice(mounts, func(i, j int) bool { return len(mounts[i].Mountpoint) > len(mounts[j].Mountpoint) })
+		if len(mounts) > 0 {
+			if err := unix.Mount("", mounts[0].Mountpoint, "", unix.MS_SLAVE, ""); err != nil {
+				return err
+			}
+		}
+	}
+	if err := unix.Mount("tmpfs", dir, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, "mode=755"); err != nil {
+		return fmt.Errorf("mount secrets tmpfs: %w", err)
+	}
+	for _, s := range c.Secrets {
+		mode, _ := strconv.ParseUint(s.Mode, 8, 32)
+		file := secretFile(stateDir, s.Target)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return err
+		}
+		if err := copySecret(s.Source, file, os.FileMode(mode), *s.UID, *s.GID); err != nil {
+			return fmt.Errorf("secret %s: %w", s.Source, err)
+		}
+	}
+	return nil
+}
+
+func copySecret(src, dst string, mode os.FileMode, uid, gid int) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	if err := out.Chown(uid, gid); err != nil {
+		return err
+	}
+	return out.Chmod(mode)
+}
@@ -0,0 +1,127 @@
+package command
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// socketConfig is a host unix socket bound into the sandbox
+type socketConfig struct {
+	// Path is the host socket, read from the host variable Env when empty
+	Path   string `json:"path"`
+	Target string `json:"target"`
+	// Env is set to the target inside the sandbox
+	Env string `json:"env"`
+}
+
+// parseForwardSocket parses a --forward-socket value, either the name of a
+// variable holding the socket path, like SSH_AUTH_SOCK, or path[:target]
+func parseForwardSocket(val string) (socketConfig, error) {
+	if envNamePattern.MatchString(val) {
+		return socketConfig{Env: val}, nil
+	}
+	parts := strings.SplitN(val, ":", 2)
+	s := socketConfig{Path: parts[0]}
+	if len(parts) == 2 {
+		s.Target = parts[1]
+	}
+	if !filepath.IsAbs(s.Path) {
+		return s, fmt.Errorf("invalid socket %q, expected a variable name or path[:target]", val)
+	}
+	return s, nil
+}
+
+// autoSockets adds the sockets of the socketEnv variables that are set on the
+// host and name a socket, unless they are forwarded explicitly
+func autoSockets(c *specConfig) error {
+	for _, name := range c.SocketEnv {
+		if !envNamePattern.MatchString(name) {
+			return fmt.Errorf("socketEnv: invalid variable name %q", name)
+		}
+		forwarded := false
+		for _, s := range c.Sockets {
+			forwarded = forwarded || s.Env == name
+		}
+		path := os.Getenv(name)
+		if forwarded || !filepath.IsAbs(path) {
+			continue
+		}
+		if fi, err := os.Stat(path); err != nil || fi.Mode()&os.ModeSocket == 0 {
+			continue
+		}
+		c.Sockets = append(c.Sockets, socketConfig{Path: path, Env: name})
+	}
+	return nil
+}
+
+// validateSockets resolves the socket paths on the host and checks they are sockets
+func validateSockets(c *specConfig) error {
+	if err := autoSockets(c); err != nil {
+		return err
+	}
+	for i := range c.Sockets {
+		s := &c.Sockets[i]
+		if s.Env != "" && !envNamePattern.MatchString(s.Env) {
+			return fmt.Errorf("socket: invalid variable name %q", s.Env)
+		}
+		if s.Path == "" {
+			if s.Env == "" {
+				return fmt.Errorf("socket needs a path or a variable name")
+			}
+			s.Path = os.Getenv(s.Env)
+			if s.Path == "" {
+				return fmt.Errorf("socket: %s is not set", s.Env)
+			}
+		}
+		if !filepath.IsAbs(s.Path) {
+			return fmt.Errorf("socket %q is not absolute", s.Path)
+		}
+		fi, err := os.Stat(s.Path)
+		if err != nil {
+			return fmt.Errorf("socket: %w", err)
+		}
+		if fi.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("%s is not a socket", s.Path)
+		}
+		if s.Target == "" {
+			s.Target = s.Path
+		}
+		if !filepath.IsAbs(s.Target) {
+			return fmt.Errorf("socket target %q is not absolute", s.Target)
+		}
+		s.Target = filepath.Clean(s.Target)
+	}
+	return nil
+}
+
+// socketMounts binds only the socket files into the sandbox
+func socketMounts(c specConfig) []specs.Mount {
+	var mounts []specs.Mount
+	for _, s := range c.Sockets {
+		mounts = append(mounts, specs.Mount{
+			Destination: s.Target,
+			Type:        "bind",
+			Source:      s.Path,
+			Options:     []string{"bind", "nosuid", "nodev", "noexec", "rprivate"},
+		})
+	}
+	return mounts
+}
+
+// socketEnv points the socket variables at the sockets in the sandbox
+func socketEnv(c specConfig) []string {
+	var env []string
+	for _, s := range c.Sockets {
+		if s.Env != "" {
+			env = append(env, s.Env+"="+s.Target)
+		}
+	}
+	return env
+}
@@ -0,0 +1,156 @@
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/opencontainers/runc/libcontainer"
+)
+
+// sandboxState is the on-disk state of a running sandbox
+type sandboxState struct {
+	id       string
+	stateDir string
+	config   specConfig
+	// image is the image the sandbox was started from, if any
+	image *image
+	// command is the process started in the sandbox
+	command []string
+}
+
+// loadSandbox finds a sandbox by its id or a unique id prefix
+func loadSandbox(idOrPrefix string) (*sandboxState, error) {
+	entries, err := os.ReadDir(containerStateRoot)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var matches []string
+	for _, entry := range entries {
+		if entry.Name() == idOrPrefix {
+			matches = []string{entry.Name()}
+			break
+		}
+		if idOrPrefix != "" && strings.HasPrefix(entry.Name(), idOrPrefix) {
+			matches = append(matches, entry.Name())
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no such sandbox: %s", idOrPrefix)
+	case 1:
+	default:
+		return nil, fmt.Errorf("sandbox id prefix %q is ambiguous", idOrPrefix)
+	}
+
+	s := &sandboxState{
+		id:       matches[0],
+		stateDir: filepath.Join(containerStateRoot, matches[0]),
+	}
+	cf, err := os.Open(filepath.Join(s.stateDir, "config"))
+	if err != nil {
+		return nil, err
+	}
+	defer cf.Close()
+	if err := json.NewDecoder(cf).Decode(&s.config); err != nil {
+		return nil, err
+	}
+	if err := readJSONFile(filepath.Join(s.stateDir, "command"), &s.command); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if s.config.Rootfs.Image != "" {
+		s.image = &image{}
+		if err := readJSONFile(filepath.Join(s.stateDir, "image.json"), s.image); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// running reports whether the init process of the sandbox is still alive. A
+// state dir left behind by a crash belongs to no running sandbox.
+func (s *sandboxState) running() bool {
+	factory, err := libcontainer.New(containerStateRoot, libcontainer.Cgroupfs)
+	if err != nil {
+		return false
+	}
+	container, err := factory.Load(s.id)
+	if err != nil {
+		return false
+	}
+	status, err := container.Status()
+	return err == nil && status != libcontainer.Stopped
+}
+
+// loadOverlaySandbox loads a sandbox that has a copy-on-write root
+func loadOverlaySandbox(idOrPrefix string) (*sandboxState, error) {
+	s, err := loadSandbox(idOrPrefix)
+	if err != nil {
+		return nil, err
+	}
+	if s.config.Rootfs.Mode != rootfsModeOverlay {
+		return nil, fmt.Errorf("sandbox %s has no copy-on-write root, start it with --rootfs-mode overlay", s.id)
+	}
+	return s, nil
+}
+
+// lowerDirs returns the read-only layers below the writable layer, the top layer first
+func (s *sandboxState) lowerDirs() ([]string, error) {
+	if s.image != nil {
+		return s.image.lowerDirs()
+	}
+	if s.config.Rootfs.Path != "" {
+		return []string{s.config.Rootfs.Path}, nil
+	}
+	return []string{"/"}, nil
+}
+
+// lowerStat stats a path in the read-only layers below the writable layer
+func (s *sandboxState) lowerStat(path string) (os.FileInfo, error) {
+	dirs, err := s.lowerDirs()
+	if err != nil {
+		return nil, err
+	}
+	_, fi, err := lookupLayers(dirs, path)
+	if err != nil {
+		return nil, err
+	}
+	if fi == nil {
+		return nil, &os.PathError{Op: "lstat", Path: path, Err: os.ErrNotExist}
+	}
+	return fi, nil
+}
+
+// lowerNames lists a directory in the read-only layers below the writable layer
+func (s *sandboxState) lowerNames(path string) ([]string, error) {
+	dirs, err := s.lowerDirs()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	seen := map[string]struct{}{}
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(filepath.Join(dir, path))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if _, ok := seen[entry.Name()]; ok {
+				continue
+			}
+			seen[entry.Name()] = struct{}{}
+			if entry.Type()&os.ModeCharDevice != 0 {
+				if fi, err := entry.Info(); err == nil && isWhiteout(fi) {
+					continue
+				}
+			}
+			names = append(names, entry.Name())
+		}
+		if isOpaque(filepath.Join(dir, path)) {
+			break
+		}
+	}
+	return names, nil
+}
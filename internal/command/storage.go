@@ -0,0 +1,117 @@
+package command
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/moby/sys/mountinfo"
+	"golang.org/x/sys/unix"
+)
+
+// storageFullBytes is the free space below which a writable layer counts as full
+const storageFullBytes = 1 << 20
+
+// validateStorageSize checks the size limit of the writable layer
+func validateStorageSize(c *specConfig) error {
+	if c.StorageSize == "" {
+		return nil
+	}
+	if _, err := parseByteSize(c.StorageSize); err != nil {
+		return fmt.Errorf("storage size: %w", err)
+	}
+	if c.Rootfs.Mode != rootfsModeOverlay {
+		return fmt.Errorf("storage size needs a copy-on-write root, use --rootfs-mode overlay or --image")
+	}
+	return nil
+}
+
+// writableDir holds the upper and work directories of an overlay root, it is
+// the mountpoint of the writable image when the storage size is limited
+func writableDir(stateDir string) string {
+	return filepath.Join(stateDir, "writable")
+}
+
+func writableImage(stateDir string) string {
+	return filepath.Join(stateDir, "writable.img")
+}
+
+// createDiskImage creates a sparse ext4 image of the given size
+func createDiskImage(path string, size int64) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(size)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if out, err := exec.Command("mkfs.ext4", "-q", "-F", "-m", "0", path).CombinedOutput(); err != nil {
+		return fmt.Errorf("mkfs.ext4: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// loopMount mounts a disk image on dir unless dir is a mountpoint already
+func loopMount(image, dir string) error {
+	mounted, err := mountinfo.Mounted(dir)
+	if err != nil || mounted {
+		return err
+	}
+	if out, err := exec.Command("mount", "-o", "loop,nosuid,nodev", image, dir).CombinedOutput(); err != nil {
+		return fmt.Errorf("mount %s: %v: %s", image, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// unmountDir detaches the filesystem mounted on dir, if any
+func unmountDir(dir string) error {
+	mounted, err := mountinfo.Mounted(dir)
+	if err != nil || !mounted {
+		return err
+	}
+	return unix.Unmount(dir, unix.MNT_DETACH)
+}
+
+// prepareLayer mounts a size limited image on the writable directory
+func prepareLayer(stateDir string, c specConfig) error {
+	if err := os.Mkdir(writableDir(stateDir), 0700); err != nil {
+		return err
+	}
+	if c.StorageSize == "" {
+		return nil
+	}
+	size, err := parseByteSize(c.StorageSize)
+	if err != nil {
+		return err
+	}
+	if err := createDiskImage(writableImage(stateDir), size); err != nil {
+		return err
+	}
+	return loopMount(writableImage(stateDir), writableDir(stateDir))
+}
+
+// releaseLayer reports a full writable image and unmounts it before the state
+// dir is removed. The sandbox keeps its own reference until it exits.
+func releaseLayer(stateDir string, w io.Writer) error {
+	mounted, err := mountinfo.Mounted(writableDir(stateDir))
+	if err != nil || !mounted {
+		return err
+	}
+	var st unix.Statfs_t
+	if err := unix.Statfs(writableDir(stateDir), &st); err == nil {
+		if st.Bavail*uint64(st.Bsize) < storageFullBytes || st.Ffree == 0 {
+			size := "its limit"
+			var c specConfig
+			if readJSONFile(filepath.Join(stateDir, "config"), &c) == nil && c.StorageSize != "" {
+				size = c.StorageSize
+			}
+			fmt.Fprintf(w, "WARNING: the writable layer is full, writes beyond %s failed with \"no space left on device\", raise --storage-size\n", size)
+		}
+	}
+	return unmountDir(writableDir(stateDir))
+}
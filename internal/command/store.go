@@ -0,0 +1,357 @@
+package command
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// imageRoot holds one record per image of the local image store
+var imageRoot = filepath.Join(stateRoot, "images")
+
+func imageRecordPath(name string) string {
+	return filepath.Join(imageRoot, url.PathEscape(name)+".json")
+}
+
+// loadStoredImage returns the image of the local store with the given name
+func loadStoredImage(name string) (*image, error) {
+	img := &image{}
+	if err := readJSONFile(imageRecordPath(name), img); err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no such image: %s", name)
+		}
+		return nil, err
+	}
+	return img, nil
+}
+
+// storeImage records an image whose layers are in the layer cache
+func storeImage(img *image) error {
+	if img.Name == "" || strings.ContainsAny(img.Name, " \t\n") {
+		return fmt.Errorf("invalid image name %q", img.Name)
+	}
+	if img.Created.IsZero() {
+		img.Created = time.Now().UTC()
+	}
+	data, err := json.MarshalIndent(img, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(imageRoot, 0700); err != nil {
+		return err
+	}
+	tmp := imageRecordPath(img.Name) + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, imageRecordPath(img.Name))
+}
+
+// listImages returns all images of the local store
+func listImages() ([]*image, error) {
+	entries, err := os.ReadDir(imageRoot)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var images []*image
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		img := &image{}
+		if err := readJSONFile(filepath.Join(imageRoot, entry.Name()), img); err != nil {
+			return nil, err
+		}
+		images = append(images, img)
+	}
+	return images, nil
+}
+
+// removeImage deletes an image record and the layers no longer in use
+func removeImage(name string) error {
+	if _, err := loadStoredImage(name); err != nil {
+		return err
+	}
+	if err := os.Remove(imageRecordPath(name)); err != nil {
+		return err
+	}
+	return pruneLayers()
+}
+
+// pruneLayers removes the cached layers not used by a stored image or a running sandbox
+func pruneLayers() error {
+	used := map[string]struct{}{}
+	images, err := listImages()
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(containerStateRoot)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range entries {
+		if s, err := loadSandbox(entry.Name()); err == nil && s.image != nil {
+			images = append(images, s.image)
+		}
+	}
+	for _, img := range images {
+		for _, layer := range img.Layers {
+			used[layer] = struct{}{}
+		}
+	}
+
+	algoDir := filepath.Join(layerRoot, "sha256")
+	layers, err := os.ReadDir(algoDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, layer := range layers {
+		if _, ok := used["sha256:"+layer.Name()]; ok {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(algoDir, layer.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type dockerManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// importImage imports a docker save archive or a flat rootfs tarball into
+// the local store. name may be empty for docker archives with a tag.
+func importImage(path, name string) (*image, error) {
+	var manifests []dockerManifest
+	err := walkArchive(path, func(hdr *tar.Header, r io.Reader) (bool, error) {
+		if filepath.Clean(hdr.Name) != "manifest.json" {
+			return true, nil
+		}
+		return false, json.NewDecoder(r).Decode(&manifests)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(manifests) > 1 {
+		return nil, fmt.Errorf("%s contains %d images, only single image archives are supported", path, len(manifests))
+	}
+	if name == "" && len(manifests) == 1 && len(manifests[0].RepoTags) > 0 {
+		name = manifests[0].RepoTags[0]
+	}
+	if name == "" {
+		return nil, fmt.Errorf("%s has no image name, use --name", path)
+	}
+
+	var img *image
+	if len(manifests) == 0 {
+		img, err = importRootfs(path)
+	} else {
+		img, err = importDockerArchive(path, manifests[0])
+	}
+	if err != nil {
+		return nil, err
+	}
+	img.Name = name
+	return img, storeImage(img)
+}
+
+func importRootfs(path string) (*image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	diffID, err := unpackLayer(f, "")
+	if err != nil {
+		return nil, err
+	}
+	return &image{Layers: []string{diffID}}, nil
+}
+
+func importDockerArchive(path string, manifest dockerManifest) (*image, error) {
+	var config ociImage
+	layerIndex := map[string]int{}
+	for i, layer := range manifest.Layers {
+		layerIndex[filepath.Clean(layer)] = i
+	}
+	diffIDs := make([]string, len(manifest.Layers))
+	unpacked := map[string]string{}
+
+	err := walkArchive(path, func(hdr *tar.Header, r io.Reader) (bool, error) {
+		name := filepath.Clean(hdr.Name)
+		if name == filepath.Clean(manifest.Config) {
+			return true, json.NewDecoder(r).Decode(&config)
+		}
+		if _, ok := layerIndex[name]; !ok || hdr.Typeflag == tar.TypeSymlink {
+			return true, nil
+		}
+		diffID, err := unpackLayer(r, "")
+		if err != nil {
+			return false, fmt.Errorf("layer %s: %w", name, err)
+		}
+		unpacked[name] = diffID
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for name, i := range layerIndex {
+		diffID, ok := unpacked[name]
+		if !ok {
+			// docker links repeated layers to the first copy
+			if target, err := archiveLinkTarget(path, name); err == nil {
+				diffID, ok = unpacked[target]
+			}
+		}
+		if !ok {
+			return nil, fmt.Errorf("layer %s is missing from %s", name, path)
+		}
+		diffIDs[i] = diffID
+	}
+	if len(config.RootFS.DiffIDs) > 0 {
+		if len(config.RootFS.DiffIDs) != len(diffIDs) {
+			return nil, fmt.Errorf("config lists %d layers, manifest %d", len(config.RootFS.DiffIDs), len(diffIDs))
+		}
+		for i := range diffIDs {
+			if config.RootFS.DiffIDs[i] != diffIDs[i] {
+				return nil, fmt.Errorf("layer %s does not match diff id %s", manifest.Layers[i], config.RootFS.DiffIDs[i])
+			}
+		}
+	}
+	return &image{Layers: diffIDs, Config: config.Config, History: config.History}, nil
+}
+
+func archiveLinkTarget(path, name string) (string, error) {
+	var target string
+	err := walkArchive(path, func(hdr *tar.Header, r io.Reader) (bool, error) {
+		if filepath.Clean(hdr.Name) != name || hdr.Typeflag != tar.TypeSymlink {
+			return true, nil
+		}
+		target = filepath.Join(filepath.Dir(name), hdr.Linkname)
+		return false, nil
+	})
+	if err == nil && target == "" {
+		err = fmt.Errorf("%s is not a link", name)
+	}
+	return target, err
+}
+
+// walkArchive calls fn for each entry of a possibly compressed tarball until fn returns false
+func walkArchive(path string, fn func(hdr *tar.Header, r io.Reader) (bool, error)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := decompress(f)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		more, err := fn(hdr, tr)
+		if err != nil || !more {
+			return err
+		}
+	}
+}
+
+func newImageCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "image",
+		Short: "Manage the local image store",
+		Args:  NoArgs,
+	}
+	cmd.AddCommand(
+		newImageImportCommand(),
+		newImageListCommand(),
+		newImageRemoveCommand(),
+	)
+	return cmd
+}
+
+func newImageImportCommand() *cobra.Command {
+	var name string
+	cmd := &cobra.Command{
+		Use:   "import FILE",
+		Short: "Import a docker save archive or a rootfs tarball",
+		Args:  ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			img, err := importImage(args[0], name)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), img.Name)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&name, "name", "", "Image name, defaults to the tag of a docker archive")
+	return cmd
+}
+
+func newImageListCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:     "ls",
+		Aliases: []string{"list"},
+		Short:   "List the images of the local store",
+		Args:    NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			images, err := listImages()
+			if err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tLAYERS\tCREATED")
+			for _, img := range images {
+				fmt.Fprintf(w, "%s\t%d\t%s\n", img.Name, len(img.Layers), img.Created.Local().Format(time.RFC3339))
+			}
+			return w.Flush()
+		},
+	}
+}
+
+func newImageRemoveCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:     "rm IMAGE [IMAGE...]",
+		Aliases: []string{"remove"},
+		Short:   "Remove images from the local store",
+		Args:    RequiresMinArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			for _, name := range args {
+				if err := removeImage(name); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,87 @@
+package command
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+const (
+	defaultTmpSize = "64m"
+	// rootfsStaging holds the per-sandbox directories the root is assembled on
+	rootfsStaging = stateRoot + "/rootfs"
+)
+
+// tmpfsSizePattern matches the size values accepted by tmpfs
+var tmpfsSizePattern = regexp.MustCompile(`^[0-9]+[kKmMgG%]?$`)
+
+// stagingDir returns the directory the root of sandbox id is assembled on
+func stagingDir(id string) string {
+	return filepath.Join(rootfsStaging, id)
+}
+
+// validateTmp checks the private /tmp and working directory settings
+func validateTmp(c *specConfig) error {
+	if c.TmpSize == "" {
+		c.TmpSize = defaultTmpSize
+	}
+	if !tmpfsSizePattern.MatchString(c.TmpSize) {
+		return fmt.Errorf("invalid tmp size %q", c.TmpSize)
+	}
+	if c.Workdir != "" && !filepath.IsAbs(c.Workdir) {
+		return fmt.Errorf("workdir %q is not absolute", c.Workdir)
+	}
+	return nil
+}
+
+// tmpMounts returns the private tmpfs mounted on /tmp unless it is shared
+func tmpMounts(c specConfig) []specs.Mount {
+	if c.SharedTmp {
+		return nil
+	}
+	return []specs.Mount{
+		{
+			Destination: "/tmp",
+			Type:        "tmpfs",
+			Source:      "tmpfs",
+			Options:     []string{"nosuid", "nodev", "mode=1777", "size=" + c.TmpSize},
+		},
+	}
+}
+
+// mountDestinations returns where the mounts are mounted in the sandbox
+func mountDestinations(mounts []specs.Mount) []string {
+	var dsts []string
+	for _, m := range mounts {
+		dsts = append(dsts, m.Destination)
+	}
+	return dsts
+}
+
+// workingDir picks the process working directory: workdir, then the
+// invoker's directory with keepCwd, then the image's, then the default
+func workingDir(c specConfig, imageDir string) (string, error) {
+	if c.Workdir != "" {
+		return filepath.Clean(c.Workdir), nil
+	}
+	if c.KeepCwd {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return "", err
+		}
+		if !c.SharedTmp && cwd != "/tmp" && underAny(cwd, []string{"/tmp"}) && !underAny(cwd, mountDestinations(c.Mounts)) {
+			return "", fmt.Errorf("the current directory %s is below /tmp, which is private to the sandbox; use sharedTmp or -w", cwd)
+		}
+		return cwd, nil
+	}
+	if imageDir != "" {
+		return imageDir, nil
+	}
+	if c.Rootfs.hostRoot() {
+		return "/tmp", nil
+	}
+	return "/", nil
+}
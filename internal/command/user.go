@@ -0,0 +1,167 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	osuser "os/user"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/runc/libcontainer/user"
+)
+
+// sandboxUser is the user the sandbox process runs as
+type sandboxUser struct {
+	// Name is empty for a numeric uid without a passwd entry
+	Name  string
+	UID   int
+	GID   int
+	Gids  []int
+	Home  string
+	Shell string
+}
+
+// resolveUser resolves a name|uid[:group|gid] user spec and the additional
+// groups against the passwd and group files of the sandbox root, including
+// the extra users
+func resolveUser(c specConfig, lowerDirs []string, spec string, groupAdd []string) (*sandboxUser, error) {
+	passwd, err := rootFile(c, lowerDirs, "/etc/passwd")
+	if err != nil {
+		return nil, err
+	}
+	group, err := rootFile(c, lowerDirs, "/etc/group")
+	if err != nil {
+		return nil, err
+	}
+	// root is uid 0 even in a root without a passwd file, like an allowlist root
+	if passwd == nil && (spec == "root" || strings.HasPrefix(spec, "root:")) {
+		spec = "0" + strings.TrimPrefix(spec, "root")
+	}
+	var nssGids []int
+	if c.Rootfs.hostRoot() {
+		passwd, group, nssGids = nssEntries(spec, passwd, group)
+	}
+	if len(c.ExtraUsers) > 0 {
+		if passwd, err = generatePasswd(passwd, c.ExtraUsers); err != nil {
+			return nil, err
+		}
+		if group, err = generateGroup(group, c.ExtraUsers); err != nil {
+			return nil, err
+		}
+	}
+
+	execUser, err := user.GetExecUser(spec, &user.ExecUser{Home: "/"}, optionalReader(passwd), optionalReader(group))
+	if err != nil {
+		return nil, fmt.Errorf("user %s: %w", spec, err)
+	}
+	u := &sandboxUser{
+		UID:  execUser.Uid,
+		GID:  execUser.Gid,
+		Gids: append(execUser.Sgids, nssGids...),
+		Home: execUser.Home,
+	}
+	entries, err := user.ParsePasswdFilter(bytes.NewReader(passwd), func(p user.User) bool {
+		return p.Uid == execUser.Uid
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) > 0 {
+		u.Name = entries[0].Name
+		u.Shell = entries[0].Shell
+	}
+
+	if len(groupAdd) > 0 {
+		gids, err := user.GetAdditionalGroups(groupAdd, optionalReader(group))
+		if err != nil {
+			return nil, err
+		}
+		u.Gids = append(u.Gids, gids...)
+	}
+	u.Gids = uniqueGids(u.Gids, u.GID)
+	return u, nil
+}
+
+// nssEntries adds the user and group of spec that the files of the host root
+// lack to them, when the host resolves them through NSS, like LDAP, SSSD or
+// systemd-homed users. It also returns the groups of such a user.
+func nssEntries(spec string, passwd, group []byte) ([]byte, []byte, []int) {
+	name, groupName := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		name, groupName = spec[:i], spec[i+1:]
+	}
+	var gids []int
+	if _, err := strconv.Atoi(name); err != nil && name != "" {
+		if _, ok := fileFields(passwd)[name]; !ok {
+			if u, err := osuser.Lookup(name); err == nil {
+				passwd = append(withNewline(passwd), fmt.Sprintf("%s:x:%s:%s::%s:\n", u.Username, u.Uid, u.Gid, u.HomeDir)...)
+				ids, _ := u.GroupIds()
+				for _, id := range ids {
+					if gid, err := strconv.Atoi(id); err == nil {
+						gids = append(gids, gid)
+					}
+				}
+			}
+		}
+	}
+	if _, err := strconv.Atoi(groupName); err != nil && groupName != "" {
+		if _, ok := fileFields(group)[groupName]; !ok {
+			if g, err := osuser.LookupGroup(groupName); err == nil {
+				group = append(withNewline(group), fmt.Sprintf("%s:x:%s:\n", g.Name, g.Gid)...)
+			}
+		}
+	}
+	return passwd, group, gids
+}
+
+// optionalReader returns nil for a missing file, which the user package
+// treats as having no entries
+func optionalReader(data []byte) io.Reader {
+	if data == nil {
+		return nil
+	}
+	return bytes.NewReader(data)
+}
+
+// uniqueGids drops duplicates and the primary gid from the additional gids
+func uniqueGids(gids []int, primary int) []int {
+	seen := map[int]struct{}{primary: {}}
+	var out []int
+	for _, gid := range gids {
+		if _, ok := seen[gid]; ok {
+			continue
+		}
+		seen[gid] = struct{}{}
+		out = append(out, gid)
+	}
+	return out
+}
+
+func additionalGids(gids []int) []uint32 {
+	var out []uint32
+	for _, gid := range gids {
+		out = append(out, uint32(gid))
+	}
+	return out
+}
+
+// homeName names the persistent home of the user, by uid without a name
+func (u *sandboxUser) homeName() string {
+	if u.Name != "" {
+		return u.Name
+	}
+	return strconv.Itoa(u.UID)
+}
+
+// env returns HOME, USER and SHELL for the user, where they are known
+func (u *sandboxUser) env() []string {
+	env := []string{"HOME=" + u.Home}
+	if u.Name != "" {
+		env = append(env, "USER="+u.Name)
+	}
+	if u.Shell != "" {
+		env = append(env, "SHELL="+u.Shell)
+	}
+	return env
+}
@@ -0,0 +1,340 @@
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/moby/sys/mountinfo"
+	"github.com/spf13/cobra"
+)
+
+// volumeRoot holds one directory per named volume
+var volumeRoot = filepath.Join(stateRoot, "volumes")
+
+var volumeNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// volume is a named directory that outlives the sandboxes mounting it
+type volume struct {
+	Name string `json:"name"`
+	UID  int    `json:"uid"`
+	GID  int    `json:"gid"`
+	// Size is the quota of the volume, it is then an ext4 image mounted on demand
+	Size    string    `json:"size,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+func (v *volume) dir() string {
+	return filepath.Join(volumeRoot, v.Name)
+}
+
+// dataDir is the directory bind mounted into sandboxes
+func (v *volume) dataDir() string {
+	return filepath.Join(v.dir(), "_data")
+}
+
+func (v *volume) diskImage() string {
+	return filepath.Join(v.dir(), "disk.img")
+}
+
+// parseByteSize parses a size such as 512m or 10g into bytes
+func parseByteSize(s string) (int64, error) {
+	units := map[byte]int64{'k': 1 << 10, 'm': 1 << 20, 'g': 1 << 30, 't': 1 << 40}
+	num, mult := strings.ToLower(s), int64(1)
+	if num != "" {
+		if u, ok := units[num[len(num)-1]]; ok {
+			num, mult = num[:len(num)-1], u
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+// loadVolume returns the volume with the given name
+func loadVolume(name string) (*volume, error) {
+	if !volumeNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid volume name %q", name)
+	}
+	v := &volume{}
+	if err := readJSONFile(filepath.Join(volumeRoot, name, "volume.json"), v); err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no such volume: %s", name)
+		}
+		return nil, err
+	}
+	return v, nil
+}
+
+// createVolume creates the volume directory, formatting and mounting the
+// disk image of a volume with a quota
+func createVolume(v *volume) error {
+	if !volumeNamePattern.MatchString(v.Name) {
+		return fmt.Errorf("invalid volume name %q", v.Name)
+	}
+	var size int64
+	if v.Size != "" {
+		var err error
+		if size, err = parseByteSize(v.Size); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(volumeRoot, 0700); err != nil {
+		return err
+	}
+	if err := os.Mkdir(v.dir(), 0700); err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("volume %s already exists", v.Name)
+		}
+		return err
+	}
+	err := initVolume(v, size)
+	if err != nil {
+		os.RemoveAll(v.dir())
+	}
+	return err
+}
+
+func initVolume(v *volume, size int64) error {
+	if err := os.Mkdir(v.dataDir(), 0755); err != nil {
+		return err
+	}
+	if size > 0 {
+		if err := createDiskImage(v.diskImage(), size); err != nil {
+			return err
+		}
+		if err := mountVolume(v); err != nil {
+			return err
+		}
+	}
+	if err := os.Chown(v.dataDir(), v.UID, v.GID); err != nil {
+		return err
+	}
+	if v.Created.IsZero() {
+		v.Created = time.Now().UTC()
+	}
+	data, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(v.dir(), "volume.json"), data, 0600)
+}
+
+// mountVolume loop mounts the disk image of a volume with a quota unless it
+// is mounted already
+func mountVolume(v *volume) error {
+	if v.Size == "" {
+		return nil
+	}
+	if err := loopMount(v.diskImage(), v.dataDir()); err != nil {
+		return fmt.Errorf("volume %s: %w", v.Name, err)
+	}
+	return nil
+}
+
+// unmountVolume detaches the disk image of a volume with a quota
+func unmountVolume(v *volume) error {
+	if err := unmountDir(v.dataDir()); err != nil {
+		return fmt.Errorf("unmount volume %s: %w", v.Name, err)
+	}
+	return nil
+}
+
+// volumeSource returns the host directory of a named volume, mounting it if needed
+func volumeSource(name string) (string, error) {
+	v, err := loadVolume(name)
+	if err != nil {
+		return "", err
+	}
+	if err := mountVolume(v); err != nil {
+		return "", err
+	}
+	return v.dataDir(), nil
+}
+
+// listVolumes returns all named volumes
+func listVolumes() ([]*volume, error) {
+	entries, err := os.ReadDir(volumeRoot)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var volumes []*volume
+	for _, entry := range entries {
+		v, err := loadVolume(entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		volumes = append(volumes, v)
+	}
+	return volumes, nil
+}
+
+// volumeUsers returns the ids of the running sandboxes mounting a volume.
+// State dirs that can not be read or whose sandbox is gone are skipped.
+func volumeUsers(v *volume) ([]string, error) {
+	entries, err := os.ReadDir(containerStateRoot)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var ids []string
+	for _, entry := range entries {
+		s, err := loadSandbox(entry.Name())
+		if err != nil || !s.running() {
+			continue
+		}
+		for _, m := range s.config.Mounts {
+			if m.Source == v.dataDir() {
+				ids = append(ids, s.id)
+				break
+			}
+		}
+	}
+	return ids, nil
+}
+
+// removeVolume deletes a volume no sandbox is using
+func removeVolume(name string) error {
+	v, err := loadVolume(name)
+	if err != nil {
+		return err
+	}
+	ids, err := volumeUsers(v)
+	if err != nil {
+		return err
+	}
+	if len(ids) > 0 {
+		return fmt.Errorf("volume %s is in use by sandbox %s", name, strings.Join(ids, ", "))
+	}
+	if err := unmountVolume(v); err != nil {
+		return err
+	}
+	// never recurse into a volume that is still mounted
+	if mounted, err := mountinfo.Mounted(v.dataDir()); err != nil || mounted {
+		return fmt.Errorf("volume %s is still mounted", name)
+	}
+	return os.RemoveAll(v.dir())
+}
+
+func newVolumeCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "volume",
+		Short: "Manage named volumes",
+		Args:  NoArgs,
+	}
+	cmd.AddCommand(
+		newVolumeCreateCommand(),
+		newVolumeListCommand(),
+		newVolumeInspectCommand(),
+		newVolumeRemoveCommand(),
+	)
+	return cmd
+}
+
+func newVolumeCreateCommand() *cobra.Command {
+	v := &volume{}
+	cmd := &cobra.Command{
+		Use:   "create NAME",
+		Short: "Create a named volume",
+		Args:  ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			v.Name = args[0]
+			if err := createVolume(v); err != nil {
+				return err
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), v.Name)
+			return nil
+		},
+	}
+	flags := cmd.Flags()
+	flags.IntVar(&v.UID, "uid", 0, "Owner uid of the volume")
+	flags.IntVar(&v.GID, "gid", 0, "Owner gid of the volume")
+	flags.StringVar(&v.Size, "size", "", "Size quota of the volume, such as 10g")
+	return cmd
+}
+
+func newVolumeListCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:     "ls",
+		Aliases: []string{"list"},
+		Short:   "List the named volumes",
+		Args:    NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			volumes, err := listVolumes()
+			if err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tOWNER\tSIZE\tCREATED")
+			for _, v := range volumes {
+				size := v.Size
+				if size == "" {
+					size = "-"
+				}
+				fmt.Fprintf(w, "%s\t%d:%d\t%s\t%s\n", v.Name, v.UID, v.GID, size, v.Created.Local().Format(time.RFC3339))
+			}
+			return w.Flush()
+		},
+	}
+}
+
+func newVolumeInspectCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "inspect VOLUME [VOLUME...]",
+		Short: "Show the details of named volumes",
+		Args:  RequiresMinArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			type volumeInfo struct {
+				*volume
+				Mountpoint string   `json:"mountpoint"`
+				Sandboxes  []string `json:"sandboxes"`
+			}
+			infos := []volumeInfo{}
+			for _, name := range args {
+				v, err := loadVolume(name)
+				if err != nil {
+					return err
+				}
+				ids, err := volumeUsers(v)
+				if err != nil {
+					return err
+				}
+				infos = append(infos, volumeInfo{volume: v, Mountpoint: v.dataDir(), Sandboxes: ids})
+			}
+			data, err := json.MarshalIndent(infos, "", "\t")
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), string(data))
+			return nil
+		},
+	}
+}
+
+func newVolumeRemoveCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:     "rm VOLUME [VOLUME...]",
+		Aliases: []string{"remove"},
+		Short:   "Remove named volumes and their data",
+		Args:    RequiresMinArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			for _, name := range args {
+				if err := removeVolume(name); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+}